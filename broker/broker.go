@@ -6,24 +6,33 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"path"
 	"strings"
 
 	"github.com/pivotal-cf/brokerapi"
 
+	"github.com/jmcarp/cf-review-app/models"
 	"github.com/jmcarp/cf-review-app/webhooks"
 )
 
 type ProvisionOptions struct {
-	Token string
-	Owner string
-	Repo  string
+	Token          string
+	InstallationID int64 `json:"installation_id"`
+	Owner          string
+	Repo           string
+	Environment    string
+	ForkDeploys    bool     `json:"fork_deploys"`
+	ForkLabel      string   `json:"fork_label"`
+	DeployLabel    string   `json:"deploy_label"`
+	Branches       []string `json:"branches"`
+	RequireSHA256  bool     `json:"require_sha256"`
 }
 
 func (o ProvisionOptions) Validate() error {
 	missing := []string{}
 
-	if o.Token == "" {
-		missing = append(missing, "token")
+	if o.Token == "" && o.InstallationID == 0 {
+		missing = append(missing, "token or installation_id")
 	}
 	if o.Owner == "" {
 		missing = append(missing, "owner")
@@ -32,10 +41,28 @@ func (o ProvisionOptions) Validate() error {
 		missing = append(missing, "repo")
 	}
 
-	if len(missing) == 0 {
-		return nil
+	if len(missing) != 0 {
+		return fmt.Errorf("Missing required fields: %s", strings.Join(missing, ", "))
 	}
-	return fmt.Errorf("Missing required fields: %s", strings.Join(missing, ", "))
+
+	if o.Token != "" && o.InstallationID != 0 {
+		return errors.New("Token and installation_id must not both be set")
+	}
+
+	if strings.Trim(o.Environment, "/") != o.Environment {
+		return errors.New("Environment must not start or end with a slash")
+	}
+
+	for _, pattern := range o.Branches {
+		if strings.Contains(pattern, ",") {
+			return fmt.Errorf("Branch pattern must not contain a comma: %s", pattern)
+		}
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("Invalid branch pattern: %s", pattern)
+		}
+	}
+	return nil
 }
 
 type ReviewBroker struct {
@@ -81,12 +108,21 @@ func (b *ReviewBroker) Provision(
 		return spec, err
 	}
 
-	_, err = b.hookManager.Create(
-		details.OrganizationGUID, instanceID,
-		options.Token, options.Owner, options.Repo,
-	)
-
-	return spec, nil
+	_, err = b.hookManager.Create(models.Hook{
+		OrgID:          details.OrganizationGUID,
+		InstanceID:     instanceID,
+		Token:          models.Encrypted(options.Token),
+		InstallationID: options.InstallationID,
+		Owner:          options.Owner,
+		Repo:           options.Repo,
+		Environment:    options.Environment,
+		ForkDeploys:    options.ForkDeploys,
+		ForkLabel:      options.ForkLabel,
+		DeployLabel:    options.DeployLabel,
+		Branches:       strings.Join(options.Branches, ","),
+		RequireSHA256:  options.RequireSHA256,
+	})
+	return spec, err
 }
 
 func (b *ReviewBroker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
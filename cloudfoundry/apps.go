@@ -0,0 +1,318 @@
+package cloudfoundry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmcarp/cf-review-app/utils"
+)
+
+type build struct {
+	GUID    string
+	State   string
+	Error   string
+	Droplet struct {
+		GUID string
+	}
+}
+
+type process struct {
+	GUID string
+	Type string
+}
+
+// createApp pushes an app from the working directory with the settings in
+// its manifest, like `cf push`
+func (cf *CloudFoundry) createApp(ctx context.Context, name, manifestPath string) (string, error) {
+	m, err := readManifest(filepath.Join(cf.dir, manifestPath), name)
+	if err != nil {
+		return "", err
+	}
+
+	appGUID, err := cf.upsertApp(ctx, name, m)
+	if err != nil {
+		return "", err
+	}
+
+	for _, service := range m.Services {
+		err = cf.bindService(ctx, appGUID, service)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	packageGUID, err := cf.uploadPackage(ctx, appGUID, filepath.Join(cf.dir, m.Path))
+	if err != nil {
+		return "", err
+	}
+
+	dropletGUID, err := cf.stage(ctx, packageGUID)
+	if err != nil {
+		return "", err
+	}
+
+	body := toOne(dropletGUID)
+	_, err = cf.do(ctx, "PATCH", fmt.Sprintf("/v3/apps/%s/relationships/current_droplet", appGUID), body, nil)
+	if err != nil {
+		return "", err
+	}
+
+	err = cf.scale(ctx, appGUID, m)
+	if err != nil {
+		return "", err
+	}
+
+	err = cf.mapRandomRoute(ctx, appGUID, name)
+	if err != nil {
+		return "", err
+	}
+
+	err = cf.restart(ctx, appGUID)
+	return appGUID, err
+}
+
+// upsertApp creates the app or updates the lifecycle and environment of an
+// existing app with the same name
+func (cf *CloudFoundry) upsertApp(ctx context.Context, name string, m manifestApp) (string, error) {
+	app := resource{}
+	found, err := cf.find(ctx, "/v3/apps", url.Values{
+		"names":       {name},
+		"space_guids": {cf.spaceGUID},
+	}, &app)
+	if err != nil {
+		return "", err
+	}
+
+	lifecycle := map[string]interface{}{
+		"type": "buildpack",
+		"data": map[string]interface{}{
+			"buildpacks": m.buildpacks(),
+		},
+	}
+	if m.Stack != "" {
+		lifecycle["data"].(map[string]interface{})["stack"] = m.Stack
+	}
+
+	if found {
+		cf.step("Updating app %s", name)
+		body := map[string]interface{}{"lifecycle": lifecycle}
+		_, err = cf.do(ctx, "PATCH", fmt.Sprintf("/v3/apps/%s", app.GUID), body, nil)
+	} else {
+		cf.step("Creating app %s", name)
+		body := map[string]interface{}{
+			"name":      name,
+			"lifecycle": lifecycle,
+			"relationships": map[string]interface{}{
+				"space": toOne(cf.spaceGUID),
+			},
+		}
+		_, err = cf.do(ctx, "POST", "/v3/apps", body, &app)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(m.Env) > 0 {
+		body := map[string]interface{}{"var": m.Env}
+		_, err = cf.do(ctx, "PATCH", fmt.Sprintf("/v3/apps/%s/environment_variables", app.GUID), body, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return app.GUID, nil
+}
+
+// uploadPackage zips dir and uploads it as a new bits package
+func (cf *CloudFoundry) uploadPackage(ctx context.Context, appGUID, dir string) (string, error) {
+	archive, err := ioutil.TempFile("", "app-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	err = utils.Zip(dir, archive)
+	if err != nil {
+		return "", err
+	}
+
+	pkg := resource{}
+	body := map[string]interface{}{
+		"type": "bits",
+		"relationships": map[string]interface{}{
+			"app": toOne(appGUID),
+		},
+	}
+	_, err = cf.do(ctx, "POST", "/v3/packages", body, &pkg)
+	if err != nil {
+		return "", err
+	}
+
+	header := bytes.Buffer{}
+	writer := multipart.NewWriter(&header)
+	_, err = writer.CreateFormFile("bits", "app.zip")
+	if err != nil {
+		return "", err
+	}
+	trailer := fmt.Sprintf("\r\n--%s--\r\n", writer.Boundary())
+
+	info, err := archive.Stat()
+	if err != nil {
+		return "", err
+	}
+	cf.step("Uploading %d bytes", info.Size())
+
+	_, err = cf.doRaw(
+		ctx, "POST", fmt.Sprintf("/v3/packages/%s/upload", pkg.GUID),
+		func() (io.Reader, error) {
+			_, err := archive.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			return io.MultiReader(bytes.NewReader(header.Bytes()), archive, strings.NewReader(trailer)), nil
+		},
+		writer.FormDataContentType(), nil,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return pkg.GUID, wait(ctx, cf.pollInterval, cf.stagingTimeout, func() (bool, error) {
+		result := struct {
+			State string
+		}{}
+		_, err := cf.do(ctx, "GET", fmt.Sprintf("/v3/packages/%s", pkg.GUID), nil, &result)
+		if err != nil {
+			return false, err
+		}
+
+		switch result.State {
+		case "READY":
+			return true, nil
+		case "FAILED", "EXPIRED":
+			return false, fmt.Errorf("Package upload %s", result.State)
+		}
+		return false, nil
+	})
+}
+
+// stage builds a package and returns the resulting droplet
+func (cf *CloudFoundry) stage(ctx context.Context, packageGUID string) (string, error) {
+	cf.step("Staging app")
+	result := build{}
+	body := map[string]interface{}{
+		"package": map[string]string{"guid": packageGUID},
+	}
+	_, err := cf.do(ctx, "POST", "/v3/builds", body, &result)
+	if err != nil {
+		return "", err
+	}
+
+	err = wait(ctx, cf.pollInterval, cf.stagingTimeout, func() (bool, error) {
+		_, err := cf.do(ctx, "GET", fmt.Sprintf("/v3/builds/%s", result.GUID), nil, &result)
+		if err != nil {
+			return false, err
+		}
+
+		switch result.State {
+		case "STAGED":
+			cf.logf("Staged droplet %s", result.Droplet.GUID)
+			return true, nil
+		case "FAILED":
+			return false, fmt.Errorf("Staging failed: %s", result.Error)
+		}
+		return false, nil
+	})
+	if err == errTimeout {
+		return "", fmt.Errorf("Staging incomplete")
+	}
+	return result.Droplet.GUID, err
+}
+
+// scale applies the manifest's command, instances, memory and disk to the
+// web process
+func (cf *CloudFoundry) scale(ctx context.Context, appGUID string, m manifestApp) error {
+	web := process{}
+	_, err := cf.do(ctx, "GET", fmt.Sprintf("/v3/apps/%s/processes/web", appGUID), nil, &web)
+	if err != nil {
+		return err
+	}
+
+	if m.Command != "" {
+		body := map[string]interface{}{"command": m.Command}
+		_, err = cf.do(ctx, "PATCH", fmt.Sprintf("/v3/processes/%s", web.GUID), body, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	body := map[string]interface{}{}
+	if m.Instances > 0 {
+		body["instances"] = m.Instances
+	}
+	if m.Memory != "" {
+		memory, err := megabytes(m.Memory)
+		if err != nil {
+			return err
+		}
+		body["memory_in_mb"] = memory
+	}
+	if m.DiskQuota != "" {
+		disk, err := megabytes(m.DiskQuota)
+		if err != nil {
+			return err
+		}
+		body["disk_in_mb"] = disk
+	}
+	if len(body) == 0 {
+		return nil
+	}
+
+	_, err = cf.do(ctx, "POST", fmt.Sprintf("/v3/processes/%s/actions/scale", web.GUID), body, nil)
+	return err
+}
+
+// restart starts the app on its current droplet and waits for an instance
+// of the web process to run
+func (cf *CloudFoundry) restart(ctx context.Context, appGUID string) error {
+	cf.step("Starting app")
+	_, err := cf.do(ctx, "POST", fmt.Sprintf("/v3/apps/%s/actions/restart", appGUID), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	err = wait(ctx, cf.pollInterval, cf.startTimeout, func() (bool, error) {
+		stats := struct {
+			Resources []struct {
+				State string
+			}
+		}{}
+		_, err := cf.do(ctx, "GET", fmt.Sprintf("/v3/apps/%s/processes/web/stats", appGUID), nil, &stats)
+		if err != nil {
+			return false, err
+		}
+
+		for _, instance := range stats.Resources {
+			switch instance.State {
+			case "RUNNING":
+				return true, nil
+			case "CRASHED":
+				return false, fmt.Errorf("App crashed")
+			}
+		}
+		return false, nil
+	})
+	if err == errTimeout {
+		return fmt.Errorf("App failed to start")
+	}
+	return err
+}
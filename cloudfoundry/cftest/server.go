@@ -0,0 +1,951 @@
+// Package cftest provides an in-memory Cloud Controller and UAA server for
+// exercising the cloudfoundry package without a real foundation.
+package cftest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	Username = "admin"
+	Password = "password"
+	Token    = "fake-token"
+	Domain   = "apps.example.com"
+)
+
+type Org struct {
+	GUID string
+	Name string
+}
+
+type Space struct {
+	GUID    string
+	Name    string
+	OrgGUID string
+}
+
+type ServicePlan struct {
+	GUID    string
+	Service string
+	Name    string
+}
+
+type ServiceInstance struct {
+	GUID       string
+	Name       string
+	SpaceGUID  string
+	PlanGUID   string
+	Tags       []string
+	Parameters map[string]interface{}
+	State      string
+	polls      int
+}
+
+type App struct {
+	GUID        string
+	Name        string
+	SpaceGUID   string
+	Buildpacks  []string
+	Env         map[string]string
+	Command     string
+	Instances   int
+	MemoryMB    int
+	DiskMB      int
+	DropletGUID string
+	Started     bool
+	Services    []string
+}
+
+type Package struct {
+	GUID    string
+	AppGUID string
+	Bits    []byte
+}
+
+type Route struct {
+	GUID      string
+	Host      string
+	SpaceGUID string
+	Apps      []string
+}
+
+func (r Route) URL() string {
+	return fmt.Sprintf("%s.%s", r.Host, Domain)
+}
+
+type failure struct {
+	method string
+	prefix string
+	status int
+	times  int
+}
+
+// Server is a fake Cloud Controller and UAA. Its zero state has no orgs or
+// service plans; register them with AddOrg and AddServicePlan.
+type Server struct {
+	*httptest.Server
+
+	mu             sync.Mutex
+	nextID         int
+	orgs           map[string]*Org
+	spaces         map[string]*Space
+	plans          map[string]*ServicePlan
+	instances      map[string]*ServiceInstance
+	apps           map[string]*App
+	packages       map[string]*Package
+	builds         map[string]string
+	routes         map[string]*Route
+	failures       []*failure
+	provisionPolls int
+	requests       []string
+}
+
+func NewServer() *Server {
+	s := &Server{
+		orgs:      map[string]*Org{},
+		spaces:    map[string]*Space{},
+		plans:     map[string]*ServicePlan{},
+		instances: map[string]*ServiceInstance{},
+		apps:      map[string]*App{},
+		packages:  map[string]*Package{},
+		builds:    map[string]string{},
+		routes:    map[string]*Route{},
+	}
+	s.Server = httptest.NewServer(s.router())
+	return s
+}
+
+// AddOrg registers an org and returns its GUID
+func (s *Server) AddOrg(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	org := &Org{GUID: s.guid("org"), Name: name}
+	s.orgs[org.GUID] = org
+	return org.GUID
+}
+
+// AddServicePlan makes a plan of a service offering available to every space
+func (s *Server) AddServicePlan(service, plan string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := &ServicePlan{GUID: s.guid("plan"), Service: service, Name: plan}
+	s.plans[p.GUID] = p
+}
+
+// SetProvisionPolls makes new service instances report "in progress" for
+// the given number of reads before they succeed
+func (s *Server) SetProvisionPolls(polls int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.provisionPolls = polls
+}
+
+// Fail makes the next `times` requests whose method matches and whose path
+// starts with prefix return status. A negative count fails forever.
+func (s *Server) Fail(method, prefix string, status, times int) {
+	if times == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &failure{method, prefix, status, times})
+}
+
+// Requests returns the method and path of every request received
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) Space(orgGUID, name string) (Space, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	space := s.findSpace(orgGUID, name)
+	if space == nil {
+		return Space{}, false
+	}
+	return *space, true
+}
+
+func (s *Server) Spaces() []Space {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	spaces := []Space{}
+	for _, space := range s.spaces {
+		spaces = append(spaces, *space)
+	}
+	return spaces
+}
+
+func (s *Server) ServiceInstances(spaceGUID string) []ServiceInstance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instances := []ServiceInstance{}
+	for _, instance := range s.instances {
+		if instance.SpaceGUID == spaceGUID {
+			instances = append(instances, *instance)
+		}
+	}
+	return instances
+}
+
+func (s *Server) Apps(spaceGUID string) []App {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	apps := []App{}
+	for _, app := range s.apps {
+		if app.SpaceGUID == spaceGUID {
+			apps = append(apps, *app)
+		}
+	}
+	return apps
+}
+
+func (s *Server) Routes(spaceGUID string) []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := []Route{}
+	for _, route := range s.routes {
+		if route.SpaceGUID == spaceGUID {
+			routes = append(routes, *route)
+		}
+	}
+	return routes
+}
+
+// Bits returns the last package uploaded for an app
+func (s *Server) Bits(appGUID string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var bits []byte
+	for _, pkg := range s.packages {
+		if pkg.AppGUID == appGUID && pkg.Bits != nil {
+			bits = pkg.Bits
+		}
+	}
+	return bits
+}
+
+func (s *Server) guid(kind string) string {
+	s.nextID++
+	return fmt.Sprintf("%s-%d", kind, s.nextID)
+}
+
+func (s *Server) findSpace(orgGUID, name string) *Space {
+	for _, space := range s.spaces {
+		if space.OrgGUID == orgGUID && space.Name == name {
+			return space
+		}
+	}
+	return nil
+}
+
+func (s *Server) router() http.Handler {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/", s.root).Methods("GET")
+	r.HandleFunc("/login/oauth/token", s.token).Methods("POST")
+
+	v3 := r.PathPrefix("/v3").Subrouter()
+	v3.HandleFunc("/organizations/{guid}", s.getOrg).Methods("GET")
+	v3.HandleFunc("/organizations/{guid}/domains/default", s.getDefaultDomain).Methods("GET")
+	v3.HandleFunc("/spaces", s.listSpaces).Methods("GET")
+	v3.HandleFunc("/spaces", s.createSpace).Methods("POST")
+	v3.HandleFunc("/spaces/{guid}", s.deleteSpace).Methods("DELETE")
+	v3.HandleFunc("/jobs/{guid}", s.getJob).Methods("GET")
+	v3.HandleFunc("/service_plans", s.listPlans).Methods("GET")
+	v3.HandleFunc("/service_instances", s.listInstances).Methods("GET")
+	v3.HandleFunc("/service_instances", s.createInstance).Methods("POST")
+	v3.HandleFunc("/service_credential_bindings", s.listBindings).Methods("GET")
+	v3.HandleFunc("/service_credential_bindings", s.createBinding).Methods("POST")
+	v3.HandleFunc("/apps", s.listApps).Methods("GET")
+	v3.HandleFunc("/apps", s.createApp).Methods("POST")
+	v3.HandleFunc("/apps/{guid}", s.updateApp).Methods("PATCH")
+	v3.HandleFunc("/apps/{guid}/environment_variables", s.updateEnv).Methods("PATCH")
+	v3.HandleFunc("/apps/{guid}/relationships/current_droplet", s.setDroplet).Methods("PATCH")
+	v3.HandleFunc("/apps/{guid}/processes/web", s.getProcess).Methods("GET")
+	v3.HandleFunc("/apps/{guid}/processes/web/stats", s.getStats).Methods("GET")
+	v3.HandleFunc("/apps/{guid}/actions/restart", s.restartApp).Methods("POST")
+	v3.HandleFunc("/apps/{guid}/routes", s.listAppRoutes).Methods("GET")
+	v3.HandleFunc("/processes/{guid}", s.updateProcess).Methods("PATCH")
+	v3.HandleFunc("/processes/{guid}/actions/scale", s.scaleProcess).Methods("POST")
+	v3.HandleFunc("/packages", s.createPackage).Methods("POST")
+	v3.HandleFunc("/packages/{guid}", s.getPackage).Methods("GET")
+	v3.HandleFunc("/packages/{guid}/upload", s.uploadPackage).Methods("POST")
+	v3.HandleFunc("/builds", s.createBuild).Methods("POST")
+	v3.HandleFunc("/builds/{guid}", s.getBuild).Methods("GET")
+	v3.HandleFunc("/routes", s.createRoute).Methods("POST")
+	v3.HandleFunc("/routes/{guid}/destinations", s.addDestinations).Methods("POST")
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, fmt.Sprintf("%s %s", req.Method, req.URL.Path))
+		status := s.injectedFailure(req)
+		s.mu.Unlock()
+
+		if status != 0 {
+			writeError(res, status, "Injected failure")
+			return
+		}
+
+		authorized := req.Header.Get("Authorization") == fmt.Sprintf("bearer %s", Token)
+		if strings.HasPrefix(req.URL.Path, "/v3/") && !authorized {
+			writeError(res, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+
+		r.ServeHTTP(res, req)
+	})
+}
+
+func (s *Server) injectedFailure(req *http.Request) int {
+	for i, f := range s.failures {
+		if f.method != req.Method || !strings.HasPrefix(req.URL.Path, f.prefix) {
+			continue
+		}
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f.status
+	}
+	return 0
+}
+
+func (s *Server) root(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"links": map[string]interface{}{
+			"login":               map[string]string{"href": s.URL + "/login"},
+			"uaa":                 map[string]string{"href": s.URL + "/login"},
+			"cloud_controller_v3": map[string]string{"href": s.URL + "/v3"},
+		},
+	})
+}
+
+func (s *Server) token(res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	if req.Form.Get("username") != Username || req.Form.Get("password") != Password {
+		writeError(res, http.StatusUnauthorized, "Bad credentials")
+		return
+	}
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"access_token": Token,
+		"token_type":   "bearer",
+		"expires_in":   3600,
+	})
+}
+
+func (s *Server) getOrg(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	org, ok := s.orgs[mux.Vars(req)["guid"]]
+	if !ok {
+		writeError(res, http.StatusNotFound, "Organization not found")
+		return
+	}
+	writeJSON(res, http.StatusOK, map[string]string{"guid": org.GUID, "name": org.Name})
+}
+
+func (s *Server) getDefaultDomain(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, map[string]string{"guid": "domain", "name": Domain})
+}
+
+func (s *Server) listSpaces(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := req.URL.Query()
+	resources := []interface{}{}
+	space := s.findSpace(query.Get("organization_guids"), query.Get("names"))
+	if space != nil {
+		resources = append(resources, map[string]string{"guid": space.GUID, "name": space.Name})
+	}
+	writeList(res, resources)
+}
+
+func (s *Server) createSpace(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Name          string
+		Relationships struct {
+			Organization relationship
+		}
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orgGUID := body.Relationships.Organization.Data.GUID
+	if _, ok := s.orgs[orgGUID]; !ok {
+		writeError(res, http.StatusUnprocessableEntity, "Invalid organization")
+		return
+	}
+	if s.findSpace(orgGUID, body.Name) != nil {
+		writeError(res, http.StatusUnprocessableEntity, "Name must be unique per organization")
+		return
+	}
+
+	space := &Space{GUID: s.guid("space"), Name: body.Name, OrgGUID: orgGUID}
+	s.spaces[space.GUID] = space
+	writeJSON(res, http.StatusCreated, map[string]string{"guid": space.GUID, "name": space.Name})
+}
+
+// deleteSpace deletes a space and everything in it
+func (s *Server) deleteSpace(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	guid := mux.Vars(req)["guid"]
+	if _, ok := s.spaces[guid]; !ok {
+		writeError(res, http.StatusNotFound, "Space not found")
+		return
+	}
+
+	delete(s.spaces, guid)
+	for id, instance := range s.instances {
+		if instance.SpaceGUID == guid {
+			delete(s.instances, id)
+		}
+	}
+	for id, app := range s.apps {
+		if app.SpaceGUID == guid {
+			delete(s.apps, id)
+		}
+	}
+	for id, route := range s.routes {
+		if route.SpaceGUID == guid {
+			delete(s.routes, id)
+		}
+	}
+	s.writeJob(res)
+}
+
+func (s *Server) getJob(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, map[string]string{
+		"guid":  mux.Vars(req)["guid"],
+		"state": "COMPLETE",
+	})
+}
+
+func (s *Server) listPlans(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := req.URL.Query()
+	resources := []interface{}{}
+	for _, plan := range s.plans {
+		if plan.Name == query.Get("names") && plan.Service == query.Get("service_offering_names") {
+			resources = append(resources, map[string]string{"guid": plan.GUID, "name": plan.Name})
+		}
+	}
+	writeList(res, resources)
+}
+
+func (s *Server) listInstances(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := req.URL.Query()
+	resources := []interface{}{}
+	for _, instance := range s.instances {
+		if instance.Name != query.Get("names") || instance.SpaceGUID != query.Get("space_guids") {
+			continue
+		}
+		if instance.State == "in progress" {
+			instance.polls--
+			if instance.polls < 0 {
+				instance.State = "succeeded"
+			}
+		}
+		resources = append(resources, map[string]interface{}{
+			"guid": instance.GUID,
+			"name": instance.Name,
+			"last_operation": map[string]string{
+				"type":  "create",
+				"state": instance.State,
+			},
+		})
+	}
+	writeList(res, resources)
+}
+
+func (s *Server) createInstance(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Name          string
+		Tags          []string
+		Parameters    map[string]interface{}
+		Relationships struct {
+			Space       relationship
+			ServicePlan relationship `json:"service_plan"`
+		}
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.plans[body.Relationships.ServicePlan.Data.GUID]; !ok {
+		writeError(res, http.StatusUnprocessableEntity, "Invalid service plan")
+		return
+	}
+
+	instance := &ServiceInstance{
+		GUID:       s.guid("service-instance"),
+		Name:       body.Name,
+		SpaceGUID:  body.Relationships.Space.Data.GUID,
+		PlanGUID:   body.Relationships.ServicePlan.Data.GUID,
+		Tags:       body.Tags,
+		Parameters: body.Parameters,
+		State:      "in progress",
+		polls:      s.provisionPolls,
+	}
+	s.instances[instance.GUID] = instance
+	s.writeJob(res)
+}
+
+func (s *Server) listBindings(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := req.URL.Query()
+	resources := []interface{}{}
+	app, ok := s.apps[query.Get("app_guids")]
+	if ok {
+		for _, guid := range app.Services {
+			if guid == query.Get("service_instance_guids") {
+				resources = append(resources, map[string]string{"guid": app.GUID + "-" + guid})
+			}
+		}
+	}
+	writeList(res, resources)
+}
+
+func (s *Server) createBinding(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Relationships struct {
+			App             relationship
+			ServiceInstance relationship `json:"service_instance"`
+		}
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app, ok := s.apps[body.Relationships.App.Data.GUID]
+	if !ok {
+		writeError(res, http.StatusUnprocessableEntity, "Invalid app")
+		return
+	}
+	app.Services = append(app.Services, body.Relationships.ServiceInstance.Data.GUID)
+	s.writeJob(res)
+}
+
+func (s *Server) listApps(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := req.URL.Query()
+	resources := []interface{}{}
+	for _, app := range s.apps {
+		if app.Name == query.Get("names") && app.SpaceGUID == query.Get("space_guids") {
+			resources = append(resources, map[string]string{"guid": app.GUID, "name": app.Name})
+		}
+	}
+	writeList(res, resources)
+}
+
+type lifecycle struct {
+	Data struct {
+		Buildpacks []string
+	}
+}
+
+func (s *Server) createApp(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Name          string
+		Lifecycle     lifecycle
+		Relationships struct {
+			Space relationship
+		}
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := &App{
+		GUID:       s.guid("app"),
+		Name:       body.Name,
+		SpaceGUID:  body.Relationships.Space.Data.GUID,
+		Buildpacks: body.Lifecycle.Data.Buildpacks,
+		Instances:  1,
+	}
+	s.apps[app.GUID] = app
+	writeJSON(res, http.StatusCreated, map[string]string{"guid": app.GUID, "name": app.Name})
+}
+
+func (s *Server) updateApp(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Lifecycle lifecycle
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.withApp(res, req, func(app *App) {
+		app.Buildpacks = body.Lifecycle.Data.Buildpacks
+	})
+}
+
+func (s *Server) updateEnv(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Var map[string]string
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.withApp(res, req, func(app *App) {
+		app.Env = body.Var
+	})
+}
+
+func (s *Server) setDroplet(res http.ResponseWriter, req *http.Request) {
+	body := relationship{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.withApp(res, req, func(app *App) {
+		app.DropletGUID = body.Data.GUID
+	})
+}
+
+func (s *Server) getProcess(res http.ResponseWriter, req *http.Request) {
+	s.withApp(res, req, func(app *App) {})
+}
+
+func (s *Server) getStats(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app, ok := s.apps[mux.Vars(req)["guid"]]
+	if !ok {
+		writeError(res, http.StatusNotFound, "App not found")
+		return
+	}
+
+	state := "DOWN"
+	if app.Started {
+		state = "RUNNING"
+	}
+	resources := []interface{}{}
+	for i := 0; i < app.Instances; i++ {
+		resources = append(resources, map[string]interface{}{"index": i, "state": state})
+	}
+	writeList(res, resources)
+}
+
+func (s *Server) restartApp(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app, ok := s.apps[mux.Vars(req)["guid"]]
+	if !ok {
+		writeError(res, http.StatusNotFound, "App not found")
+		return
+	}
+	if app.DropletGUID == "" {
+		writeError(res, http.StatusUnprocessableEntity, "Assign a droplet before starting this app")
+		return
+	}
+	app.Started = true
+	writeJSON(res, http.StatusOK, map[string]string{"guid": app.GUID, "state": "STARTED"})
+}
+
+func (s *Server) listAppRoutes(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	guid := mux.Vars(req)["guid"]
+	resources := []interface{}{}
+	for _, route := range s.routes {
+		for _, app := range route.Apps {
+			if app == guid {
+				resources = append(resources, map[string]string{"guid": route.GUID, "url": route.URL()})
+			}
+		}
+	}
+	writeList(res, resources)
+}
+
+// Processes share the GUID of their app, since the fake only models the
+// web process
+func (s *Server) updateProcess(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Command string
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.withApp(res, req, func(app *App) {
+		app.Command = body.Command
+	})
+}
+
+func (s *Server) scaleProcess(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Instances  int
+		MemoryInMB int `json:"memory_in_mb"`
+		DiskInMB   int `json:"disk_in_mb"`
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.withApp(res, req, func(app *App) {
+		if body.Instances > 0 {
+			app.Instances = body.Instances
+		}
+		if body.MemoryInMB > 0 {
+			app.MemoryMB = body.MemoryInMB
+		}
+		if body.DiskInMB > 0 {
+			app.DiskMB = body.DiskInMB
+		}
+	})
+}
+
+func (s *Server) createPackage(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Relationships struct {
+			App relationship
+		}
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pkg := &Package{GUID: s.guid("package"), AppGUID: body.Relationships.App.Data.GUID}
+	s.packages[pkg.GUID] = pkg
+	writeJSON(res, http.StatusCreated, map[string]string{"guid": pkg.GUID, "state": "AWAITING_UPLOAD"})
+}
+
+func (s *Server) getPackage(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pkg, ok := s.packages[mux.Vars(req)["guid"]]
+	if !ok {
+		writeError(res, http.StatusNotFound, "Package not found")
+		return
+	}
+
+	state := "AWAITING_UPLOAD"
+	if pkg.Bits != nil {
+		state = "READY"
+	}
+	writeJSON(res, http.StatusOK, map[string]string{"guid": pkg.GUID, "state": state})
+}
+
+func (s *Server) uploadPackage(res http.ResponseWriter, req *http.Request) {
+	file, _, err := req.FormFile("bits")
+	if err != nil {
+		writeError(res, http.StatusBadRequest, "Missing bits")
+		return
+	}
+	defer file.Close()
+
+	bits, err := ioutil.ReadAll(file)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, "Invalid bits")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pkg, ok := s.packages[mux.Vars(req)["guid"]]
+	if !ok {
+		writeError(res, http.StatusNotFound, "Package not found")
+		return
+	}
+	pkg.Bits = bits
+	writeJSON(res, http.StatusOK, map[string]string{"guid": pkg.GUID, "state": "PROCESSING_UPLOAD"})
+}
+
+func (s *Server) createBuild(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Package struct {
+			GUID string
+		}
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.packages[body.Package.GUID]; !ok {
+		writeError(res, http.StatusUnprocessableEntity, "Invalid package")
+		return
+	}
+
+	guid := s.guid("build")
+	s.builds[guid] = s.guid("droplet")
+	writeJSON(res, http.StatusCreated, map[string]string{"guid": guid, "state": "STAGING"})
+}
+
+func (s *Server) getBuild(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	guid := mux.Vars(req)["guid"]
+	droplet, ok := s.builds[guid]
+	if !ok {
+		writeError(res, http.StatusNotFound, "Build not found")
+		return
+	}
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"guid":    guid,
+		"state":   "STAGED",
+		"droplet": map[string]string{"guid": droplet},
+	})
+}
+
+func (s *Server) createRoute(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Host          string
+		Relationships struct {
+			Space relationship
+		}
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	route := &Route{GUID: s.guid("route"), Host: body.Host, SpaceGUID: body.Relationships.Space.Data.GUID}
+	s.routes[route.GUID] = route
+	writeJSON(res, http.StatusCreated, map[string]string{"guid": route.GUID, "url": route.URL()})
+}
+
+func (s *Server) addDestinations(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Destinations []struct {
+			App struct {
+				GUID string
+			}
+		}
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	route, ok := s.routes[mux.Vars(req)["guid"]]
+	if !ok {
+		writeError(res, http.StatusNotFound, "Route not found")
+		return
+	}
+	for _, destination := range body.Destinations {
+		route.Apps = append(route.Apps, destination.App.GUID)
+	}
+	writeJSON(res, http.StatusOK, map[string]interface{}{"destinations": body.Destinations})
+}
+
+func (s *Server) withApp(res http.ResponseWriter, req *http.Request, update func(app *App)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app, ok := s.apps[mux.Vars(req)["guid"]]
+	if !ok {
+		writeError(res, http.StatusNotFound, "App not found")
+		return
+	}
+	update(app)
+	writeJSON(res, http.StatusOK, map[string]string{"guid": app.GUID, "name": app.Name})
+}
+
+func (s *Server) writeJob(res http.ResponseWriter) {
+	res.Header().Set("Location", fmt.Sprintf("%s/v3/jobs/%s", s.URL, s.guid("job")))
+	res.WriteHeader(http.StatusAccepted)
+}
+
+type relationship struct {
+	Data struct {
+		GUID string
+	}
+}
+
+func readJSON(res http.ResponseWriter, req *http.Request, body interface{}) bool {
+	err := json.NewDecoder(req.Body).Decode(body)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+	return true
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(body)
+}
+
+func writeList(res http.ResponseWriter, resources []interface{}) {
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"pagination": map[string]int{"total_results": len(resources)},
+		"resources":  resources,
+	})
+}
+
+func writeError(res http.ResponseWriter, status int, detail string) {
+	writeJSON(res, status, map[string]interface{}{
+		"errors": []map[string]interface{}{
+			{"code": 10000 + status, "title": http.StatusText(status), "detail": detail},
+		},
+	})
+}
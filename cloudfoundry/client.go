@@ -0,0 +1,272 @@
+package cloudfoundry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmcarp/cf-review-app/utils"
+)
+
+// APIError is an error response from the Cloud Controller or UAA
+type APIError struct {
+	StatusCode int
+	Errors     []struct {
+		Code   int
+		Title  string
+		Detail string
+	}
+}
+
+func (e *APIError) Error() string {
+	details := []string{}
+	for _, err := range e.Errors {
+		details = append(details, fmt.Sprintf("%s: %s", err.Title, err.Detail))
+	}
+	if len(details) == 0 {
+		return fmt.Sprintf("Cloud Foundry API returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("Cloud Foundry API returned status %d: %s", e.StatusCode, strings.Join(details, "; "))
+}
+
+type token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	expiry      time.Time
+}
+
+func (t *token) valid() bool {
+	return t != nil && t.AccessToken != "" && time.Now().Before(t.expiry)
+}
+
+// IsTransient reports whether a failed request may succeed if retried
+func IsTransient(err error) bool {
+	if apiErr, ok := err.(*APIError); ok {
+		return utils.IsTransientStatus(apiErr.StatusCode)
+	}
+	return utils.IsNetworkError(err)
+}
+
+// isRejected reports whether a failed request was refused before it had any
+// effect, so that it can be retried even if it isn't idempotent
+func isRejected(err error) bool {
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	return utils.IsUnsent(err)
+}
+
+// login fetches a UAA token with the password grant, using the UAA server
+// advertised by the Cloud Controller root endpoint
+func (cf *CloudFoundry) login(ctx context.Context) error {
+	root := struct {
+		Links struct {
+			Login struct {
+				Href string
+			}
+		}
+	}{}
+	_, err := cf.send(ctx, func() (*http.Request, error) {
+		return newRequest("GET", cf.api, nil, "")
+	}, &root)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {cf.username},
+		"password":   {cf.password},
+	}
+	t := token{}
+	_, err = cf.send(ctx, func() (*http.Request, error) {
+		req, err := newRequest(
+			"POST", strings.TrimRight(root.Links.Login.Href, "/")+"/oauth/token",
+			strings.NewReader(form.Encode()), "application/x-www-form-urlencoded",
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth("cf", "")
+		return req, nil
+	}, &t)
+	if err != nil {
+		return err
+	}
+
+	// Renew the token a little before it expires
+	t.expiry = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - time.Minute)
+	cf.token = &t
+	return nil
+}
+
+// do sends an authenticated JSON request to the Cloud Controller. If result
+// is not nil, the response body is decoded into it.
+func (cf *CloudFoundry) do(ctx context.Context, method, path string, body, result interface{}) (*http.Response, error) {
+	var buf []byte
+	if body != nil {
+		var err error
+		buf, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cf.doRaw(ctx, method, path, func() (io.Reader, error) {
+		if buf == nil {
+			return nil, nil
+		}
+		return bytes.NewReader(buf), nil
+	}, "application/json", result)
+}
+
+// doRaw sends an authenticated request to the Cloud Controller. The body
+// function is called once per attempt, so that requests can be retried.
+func (cf *CloudFoundry) doRaw(ctx context.Context, method, path string, body func() (io.Reader, error), contentType string, result interface{}) (*http.Response, error) {
+	if !cf.token.valid() {
+		err := cf.login(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cf.send(ctx, func() (*http.Request, error) {
+		reader, err := body()
+		if err != nil {
+			return nil, err
+		}
+		req, err := newRequest(method, cf.url(path), reader, contentType)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("%s %s", cf.token.TokenType, cf.token.AccessToken))
+		return req, nil
+	}, result)
+}
+
+func newRequest(method, u string, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// send sends the request built by newReq, retrying transient failures.
+// Requests that aren't idempotent, such as creating a space, are only
+// retried if they were rejected outright, so that a create that may have
+// succeeded isn't repeated.
+func (cf *CloudFoundry) send(ctx context.Context, newReq func() (*http.Request, error), result interface{}) (*http.Response, error) {
+	var req *http.Request
+	var resp *http.Response
+	transient := func(err error) bool {
+		if req == nil || !utils.IsIdempotent(req.Method) {
+			return isRejected(err)
+		}
+		return IsTransient(err)
+	}
+	err := utils.Retry(ctx, cf.backoff, transient, func() error {
+		var err error
+		req, err = newReq()
+		if err != nil {
+			return err
+		}
+		resp, err = cf.sendOnce(ctx, req, result)
+		return err
+	})
+	return resp, err
+}
+
+func (cf *CloudFoundry) sendOnce(ctx context.Context, req *http.Request, result interface{}) (*http.Response, error) {
+	resp, err := cf.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode >= 400 {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		json.Unmarshal(buf, apiErr)
+		return resp, apiErr
+	}
+
+	if result != nil && len(buf) > 0 {
+		err = json.Unmarshal(buf, result)
+	}
+	return resp, err
+}
+
+func (cf *CloudFoundry) url(path string) string {
+	return strings.TrimRight(cf.api, "/") + path
+}
+
+// wait polls check every interval until it reports completion, the timeout
+// elapses, or ctx is cancelled
+func wait(ctx context.Context, interval, timeout time.Duration, check func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return errTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// waitForJob polls an asynchronous Cloud Controller job until it completes.
+// Location is the job URL returned by the request that started it.
+func (cf *CloudFoundry) waitForJob(ctx context.Context, location string, timeout time.Duration) error {
+	if location == "" {
+		return nil
+	}
+	path := strings.TrimPrefix(location, strings.TrimRight(cf.api, "/"))
+
+	return wait(ctx, cf.pollInterval, timeout, func() (bool, error) {
+		job := struct {
+			State  string
+			Errors []struct {
+				Detail string
+			}
+		}{}
+		_, err := cf.do(ctx, "GET", path, nil, &job)
+		if err != nil {
+			return false, err
+		}
+
+		switch job.State {
+		case "COMPLETE":
+			return true, nil
+		case "FAILED":
+			if len(job.Errors) > 0 {
+				return false, fmt.Errorf("Job failed: %s", job.Errors[0].Detail)
+			}
+			return false, fmt.Errorf("Job failed")
+		}
+		return false, nil
+	})
+}
@@ -1,194 +1,140 @@
 package cloudfoundry
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"os/exec"
-	"strings"
+	"io/ioutil"
+	"net/http"
 	"time"
 
-	"github.com/cloudfoundry/cli/cf/api/resources"
-
 	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/utils"
 )
 
+var errTimeout = errors.New("Timed out")
+
+// CloudFoundry deploys review apps through the Cloud Controller v3 and UAA
+// APIs
 type CloudFoundry struct {
-	api      string
-	username string
-	password string
+	api       string
+	username  string
+	password  string
+	client    *http.Client
+	token     *token
+	orgGUID   string
+	spaceGUID string
+	dir       string
+	output    io.Writer
+	backoff   utils.Backoff
+
+	pollInterval   time.Duration
+	serviceTimeout time.Duration
+	stagingTimeout time.Duration
+	startTimeout   time.Duration
+	deleteTimeout  time.Duration
 }
 
 func NewCloudFoundry(api, username, password string) *CloudFoundry {
-	return &CloudFoundry{api, username, password}
+	return &CloudFoundry{
+		api:            api,
+		username:       username,
+		password:       password,
+		client:         &http.Client{Timeout: 5 * time.Minute},
+		output:         ioutil.Discard,
+		backoff:        utils.DefaultBackoff,
+		pollInterval:   5 * time.Second,
+		serviceTimeout: 30 * time.Second,
+		stagingTimeout: 15 * time.Minute,
+		startTimeout:   5 * time.Minute,
+		deleteTimeout:  5 * time.Minute,
+	}
 }
 
-func (cf *CloudFoundry) Login() error {
-	args := []string{"api", cf.api}
+// SetPollInterval sets how often provisioning, staging and startup are
+// checked while waiting for them to finish
+func (cf *CloudFoundry) SetPollInterval(interval time.Duration) {
+	cf.pollInterval = interval
+}
 
-	err := cf.cf(args...).Run()
-	if err != nil {
-		return err
-	}
+// Session returns a copy of the client with its own token and target that
+// pushes apps from dir and logs its progress to output, so that concurrent
+// deploys don't share state
+func (cf *CloudFoundry) Session(dir string, output io.Writer) *CloudFoundry {
+	session := *cf
+	session.token = nil
+	session.orgGUID = ""
+	session.spaceGUID = ""
+	session.dir = dir
+	session.output = output
+	return &session
+}
 
-	return cf.cf("auth", cf.username, cf.password).Run()
+func (cf *CloudFoundry) Login(ctx context.Context) error {
+	return cf.login(ctx)
 }
 
-func (cf *CloudFoundry) Target(orgID string) error {
-	org, err := cf.getOrg(orgID)
+func (cf *CloudFoundry) Target(ctx context.Context, orgID string) error {
+	org, err := cf.getOrg(ctx, orgID)
 	if err != nil {
 		return err
 	}
 
-	args := []string{"target", "-o", org}
-	return cf.cf(args...).Run()
+	cf.orgGUID = org.GUID
+	cf.logf("Targeted org %s", org.Name)
+	return nil
 }
 
-func (cf *CloudFoundry) Create(app models.App, space string) (string, error) {
-	err := cf.createSpace(space)
+// Create deploys an app and its services to a space, creating the space if
+// needed, and returns the app's route
+func (cf *CloudFoundry) Create(ctx context.Context, app models.App, space string) (string, error) {
+	err := cf.createSpace(ctx, space)
 	if err != nil {
 		return "", err
 	}
 
-	err = cf.createServices(app)
+	err = cf.createServices(ctx, app)
 	if err != nil {
 		return "", err
 	}
 
-	err = cf.createApp(app.Name, app.Manifest)
+	appGUID, err := cf.createApp(ctx, app.Name, app.Manifest)
 	if err != nil {
 		return "", err
 	}
 
-	return cf.getRoute(app.Name)
-}
-
-func (cf *CloudFoundry) Delete(space string) error {
-	return cf.deleteSpace(space)
-}
-
-func (cf *CloudFoundry) createSpace(space string) error {
-	args := []string{"create-space", space}
-	err := cf.cf(args...).Run()
-	if err != nil {
-		return err
-	}
-
-	args = []string{"target", "-s", space}
-	return cf.cf(args...).Run()
-}
-
-func (cf *CloudFoundry) deleteSpace(space string) error {
-	args := []string{"delete-space", space, "-f"}
-	return cf.cf(args...).Run()
-}
-
-func (cf *CloudFoundry) createServices(app models.App) error {
-	for _, service := range app.Services {
-		err := cf.createService(service)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (cf *CloudFoundry) getOrg(orgID string) (string, error) {
-	buf := bytes.Buffer{}
-	cmd := cf.cf("curl", fmt.Sprintf("/v2/organizations/%s", orgID))
-	cmd.Stdout = io.MultiWriter(os.Stdout, &buf)
-	err := cmd.Run()
+	route, found, err := cf.getRoute(ctx, appGUID)
 	if err != nil {
 		return "", err
 	}
-
-	resource := resources.OrganizationResource{}
-	err = json.Unmarshal(buf.Bytes(), &resource)
-	return resource.Entity.Name, err
-}
-
-func (cf *CloudFoundry) createService(service models.Service) error {
-	args := []string{"create-service", service.Service, service.Plan, service.Name}
-	if len(service.Tags) > 0 {
-		args = append(args, "-t", strings.Join(service.Tags, ","))
-	}
-	if len(service.Config) > 0 {
-		config, err := json.Marshal(service.Config)
-		if err != nil {
-			return err
-		}
-		args = append(args, "-c", string(config))
-	}
-
-	err := cf.cf(args...).Run()
-	if err != nil {
-		return err
-	}
-
-	return cf.checkService(service, 30)
-}
-
-func (cf *CloudFoundry) checkService(service models.Service, timeout int) error {
-	args := []string{"service", service.Name}
-	elapsed := 0
-
-	for {
-		buf := bytes.Buffer{}
-		cmd := cf.cf(args...)
-		cmd.Stdout = io.MultiWriter(os.Stdout, &buf)
-		err := cmd.Run()
-
-		if err == nil {
-			output := buf.String()
-			for _, line := range strings.Split(output, "\n") {
-				if line == "Status: create succeeded" {
-					return nil
-				}
-			}
-		}
-
-		elapsed += 5
-		if elapsed > timeout {
-			return fmt.Errorf("Service %s incomplete", service.Name)
-		}
-
-		time.Sleep(5 * time.Second)
+	if !found {
+		return "", fmt.Errorf("No URL found for app %s", app.Name)
 	}
+	cf.logf("App %s is available at %s", app.Name, route.URL)
+	return route.URL, nil
 }
 
-func (cf *CloudFoundry) createApp(app, manifest string) error {
-	args := []string{"push", app, "-f", manifest, "--random-route"}
-	return cf.cf(args...).Run()
+// StepLogger is an output that keeps track of the step a deploy is on.
+// Sessions log the start of each step to such an output through Step.
+type StepLogger interface {
+	io.Writer
+	Step(format string, args ...interface{})
 }
 
-func (cf *CloudFoundry) cf(args ...string) *exec.Cmd {
-	cmd := exec.Command("cf", args...)
-
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	// TODO: Handle per-pull CF_HOME
-	cmd.Env = append(os.Environ(), "CF_COLOR=true")
-
-	return cmd
+func (cf *CloudFoundry) logf(format string, args ...interface{}) {
+	fmt.Fprintf(cf.output, format+"\n", args...)
 }
 
-func (cf *CloudFoundry) getRoute(name string) (string, error) {
-	buf := bytes.Buffer{}
-	cmd := cf.cf("app", name)
-	cmd.Stdout = io.MultiWriter(os.Stdout, &buf)
-	err := cmd.Run()
-	if err != nil {
-		return "", err
-	}
-
-	output := strings.Split(buf.String(), "\n")
-	for _, line := range output {
-		if strings.Index(line, "urls: ") == 0 {
-			return strings.Replace(line, "urls: ", "", 1), nil
-		}
+// step logs the start of a step of a deploy
+func (cf *CloudFoundry) step(format string, args ...interface{}) {
+	if steps, ok := cf.output.(StepLogger); ok {
+		steps.Step(format, args...)
+		return
 	}
+	cf.logf(format, args...)
+}
 
-	return "", fmt.Errorf("No URL found for app %s", name)
+func (cf *CloudFoundry) Delete(ctx context.Context, space string) error {
+	return cf.deleteSpace(ctx, space)
 }
@@ -0,0 +1,200 @@
+package cloudfoundry
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmcarp/cf-review-app/cloudfoundry/cftest"
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/utils"
+)
+
+const testManifest = `
+applications:
+- name: web
+  buildpack: python_buildpack
+  memory: 256M
+  instances: 2
+  env:
+    DEBUG: "true"
+  services:
+  - db
+`
+
+var testApp = models.App{
+	Name:     "web",
+	Manifest: "manifest.yml",
+	Services: []models.Service{
+		{Name: "db", Service: "postgres", Plan: "small"},
+	},
+}
+
+// newTestSession logs in to a fake Cloud Controller with one org and a
+// postgres plan, pushing apps from a directory holding testManifest. Call
+// close when the test is done.
+func newTestSession(t *testing.T) (cf *CloudFoundry, server *cftest.Server, orgGUID string, close func()) {
+	server = cftest.NewServer()
+	orgGUID = server.AddOrg("review")
+	server.AddServicePlan("postgres", "small")
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"manifest.yml": testManifest,
+		"index.html":   "hello",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := NewCloudFoundry(server.URL, cftest.Username, cftest.Password)
+	client.SetPollInterval(time.Millisecond)
+	session := client.Session(dir, &bytes.Buffer{})
+	session.backoff = utils.Backoff{Attempts: 3, Initial: time.Millisecond, Max: time.Millisecond}
+
+	ctx := context.Background()
+	err = session.Login(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.Target(ctx, orgGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session, server, orgGUID, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	cf, server, orgGUID, close := newTestSession(t)
+	defer close()
+
+	url, err := cf.Create(context.Background(), testApp, "review-pull-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	space, ok := server.Space(orgGUID, "review-pull-1")
+	if !ok {
+		t.Fatal("Space was not created")
+	}
+
+	instances := server.ServiceInstances(space.GUID)
+	if len(instances) != 1 || instances[0].Name != "db" {
+		t.Fatalf("Expected service db, got %+v", instances)
+	}
+
+	apps := server.Apps(space.GUID)
+	if len(apps) != 1 {
+		t.Fatalf("Expected one app, got %d", len(apps))
+	}
+	app := apps[0]
+	if !app.Started || app.Instances != 2 || app.MemoryMB != 256 {
+		t.Errorf("App was not scaled and started: %+v", app)
+	}
+	if app.Env["DEBUG"] != "true" {
+		t.Errorf("App environment was not set: %+v", app.Env)
+	}
+	if len(app.Services) != 1 || app.Services[0] != instances[0].GUID {
+		t.Errorf("App is not bound to db: %+v", app.Services)
+	}
+	if len(server.Bits(app.GUID)) == 0 {
+		t.Error("No package was uploaded")
+	}
+
+	routes := server.Routes(space.GUID)
+	if len(routes) != 1 || routes[0].URL() != url {
+		t.Errorf("Expected route %s, got %+v", url, routes)
+	}
+}
+
+func TestCreateExistingApp(t *testing.T) {
+	cf, server, orgGUID, close := newTestSession(t)
+	defer close()
+
+	first, err := cf.Create(context.Background(), testApp, "review-pull-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cf.Create(context.Background(), testApp, "review-pull-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Errorf("Redeploy changed the route from %s to %s", first, second)
+	}
+	space, _ := server.Space(orgGUID, "review-pull-1")
+	if apps := server.Apps(space.GUID); len(apps) != 1 {
+		t.Errorf("Expected one app, got %d", len(apps))
+	}
+	if instances := server.ServiceInstances(space.GUID); len(instances) != 1 {
+		t.Errorf("Expected one service, got %d", len(instances))
+	}
+}
+
+func TestCreateRetriesTransientFailure(t *testing.T) {
+	cf, server, orgGUID, close := newTestSession(t)
+	defer close()
+	server.Fail("GET", "/v3/apps", 502, 2)
+
+	_, err := cf.Create(context.Background(), testApp, "review-pull-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	space, _ := server.Space(orgGUID, "review-pull-1")
+	if apps := server.Apps(space.GUID); len(apps) != 1 {
+		t.Errorf("Expected one app, got %d", len(apps))
+	}
+}
+
+func TestCreateMissingPlan(t *testing.T) {
+	cf, _, _, close := newTestSession(t)
+	defer close()
+
+	app := testApp
+	app.Services = []models.Service{{Name: "cache", Service: "redis", Plan: "small"}}
+	_, err := cf.Create(context.Background(), app, "review-pull-1")
+	if err == nil {
+		t.Fatal("Expected an error for a missing service plan")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	cf, server, orgGUID, close := newTestSession(t)
+	defer close()
+
+	_, err := cf.Create(context.Background(), testApp, "review-pull-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cf.Delete(context.Background(), "review-pull-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := server.Space(orgGUID, "review-pull-1"); ok {
+		t.Error("Space was not deleted")
+	}
+
+	// Deleting a space that doesn't exist succeeds, so that a review app
+	// can be torn down again
+	err = cf.Delete(context.Background(), "review-pull-1")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,85 @@
+package cloudfoundry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// https://docs.cloudfoundry.org/devguide/deploy-apps/manifest-attributes.html
+type manifest struct {
+	Applications []manifestApp
+}
+
+type manifestApp struct {
+	Name       string
+	Path       string
+	Command    string
+	Buildpack  string
+	Buildpacks []string
+	Stack      string
+	Memory     string
+	DiskQuota  string `yaml:"disk_quota"`
+	Instances  int
+	Env        map[string]string
+	Services   []string
+}
+
+// readManifest returns the manifest entry for the named app, falling back to
+// the first entry as `cf push` does when a single app is listed
+func readManifest(path, name string) (manifestApp, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return manifestApp{}, err
+	}
+
+	m := manifest{}
+	err = yaml.Unmarshal(content, &m)
+	if err != nil {
+		return manifestApp{}, err
+	}
+
+	for _, app := range m.Applications {
+		if app.Name == name {
+			return app, nil
+		}
+	}
+	if len(m.Applications) == 1 {
+		return m.Applications[0], nil
+	}
+	return manifestApp{}, fmt.Errorf("App %s not found in manifest", name)
+}
+
+func (a manifestApp) buildpacks() []string {
+	if len(a.Buildpacks) > 0 {
+		return a.Buildpacks
+	}
+	if a.Buildpack != "" {
+		return []string{a.Buildpack}
+	}
+	return []string{}
+}
+
+// megabytes parses a manifest quantity such as "256M" or "1G"
+func megabytes(quantity string) (int, error) {
+	q := strings.ToUpper(strings.TrimSpace(quantity))
+	q = strings.TrimSuffix(q, "B")
+
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(q, "G"):
+		multiplier = 1024
+		q = strings.TrimSuffix(q, "G")
+	case strings.HasSuffix(q, "M"):
+		q = strings.TrimSuffix(q, "M")
+	}
+
+	n, err := strconv.Atoi(q)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid quantity %q", quantity)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,125 @@
+package cloudfoundry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMegabytes(t *testing.T) {
+	tests := []struct {
+		quantity string
+		expected int
+		valid    bool
+	}{
+		{"256M", 256, true},
+		{"256MB", 256, true},
+		{"256m", 256, true},
+		{"1G", 1024, true},
+		{"2gb", 2048, true},
+		{" 512M ", 512, true},
+		{"512", 512, true},
+		{"", 0, false},
+		{"M", 0, false},
+		{"1.5G", 0, false},
+		{"1T", 0, false},
+		{"lots", 0, false},
+	}
+
+	for _, test := range tests {
+		n, err := megabytes(test.quantity)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %t, got error %v", test.quantity, test.valid, err)
+			continue
+		}
+		if n != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.quantity, test.expected, n)
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	single := write("single.yml", `
+applications:
+- name: other
+  buildpack: python_buildpack
+  memory: 256M
+  disk_quota: 1G
+  instances: 2
+  env:
+    DEBUG: "true"
+  services:
+  - db
+`)
+	several := write("several.yml", `
+applications:
+- name: worker
+  command: ./worker
+- name: web
+  buildpacks:
+  - nodejs_buildpack
+  - python_buildpack
+`)
+	empty := write("empty.yml", "applications: []\n")
+	invalid := write("invalid.yml", "applications: {")
+
+	tests := []struct {
+		name       string
+		path       string
+		app        string
+		valid      bool
+		appName    string
+		buildpacks []string
+	}{
+		// A single app is deployed whatever its name, as `cf push` does
+		{"single", single, "web", true, "other", []string{"python_buildpack"}},
+		{"named", several, "web", true, "web", []string{"nodejs_buildpack", "python_buildpack"}},
+		{"no buildpack", several, "worker", true, "worker", []string{}},
+		{"not found", several, "api", false, "", nil},
+		{"empty", empty, "web", false, "", nil},
+		{"invalid", invalid, "web", false, "", nil},
+		{"missing", filepath.Join(dir, "missing.yml"), "web", false, "", nil},
+	}
+
+	for _, test := range tests {
+		app, err := readManifest(test.path, test.app)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", test.name, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if app.Name != test.appName {
+			t.Errorf("%s: expected app %s, got %s", test.name, test.appName, app.Name)
+		}
+		if !reflect.DeepEqual(app.buildpacks(), test.buildpacks) {
+			t.Errorf("%s: expected buildpacks %v, got %v", test.name, test.buildpacks, app.buildpacks())
+		}
+	}
+
+	app, err := readManifest(single, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Memory != "256M" || app.DiskQuota != "1G" || app.Instances != 2 ||
+		app.Env["DEBUG"] != "true" || !reflect.DeepEqual(app.Services, []string{"db"}) {
+		t.Errorf("Unexpected app %+v", app)
+	}
+}
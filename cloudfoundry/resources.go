@@ -0,0 +1,40 @@
+package cloudfoundry
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+)
+
+type resource struct {
+	GUID string
+	Name string
+}
+
+type relationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+func toOne(guid string) relationship {
+	r := relationship{}
+	r.Data.GUID = guid
+	return r
+}
+
+// find decodes the first resource of a filtered list request into result.
+// The boolean result is false if the list is empty.
+func (cf *CloudFoundry) find(ctx context.Context, path string, query url.Values, result interface{}) (bool, error) {
+	page := struct {
+		Resources []json.RawMessage
+	}{}
+	_, err := cf.do(ctx, "GET", path+"?"+query.Encode(), nil, &page)
+	if err != nil {
+		return false, err
+	}
+	if len(page.Resources) == 0 {
+		return false, nil
+	}
+	return true, json.Unmarshal(page.Resources[0], result)
+}
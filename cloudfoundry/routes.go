@@ -0,0 +1,76 @@
+package cloudfoundry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type route struct {
+	GUID string
+	URL  string
+}
+
+var invalidHostChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// mapRandomRoute maps a route with a random host on the org's default
+// domain, like `cf push --random-route`. Apps that already have a route keep
+// it.
+func (cf *CloudFoundry) mapRandomRoute(ctx context.Context, appGUID, name string) error {
+	_, found, err := cf.getRoute(ctx, appGUID)
+	if err != nil || found {
+		return err
+	}
+
+	domain := resource{}
+	_, err = cf.do(ctx, "GET", fmt.Sprintf("/v3/organizations/%s/domains/default", cf.orgGUID), nil, &domain)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	host := invalidHostChars.ReplaceAllString(strings.ToLower(name), "-")
+	host = fmt.Sprintf("%s-%s", strings.Trim(host, "-"), hex.EncodeToString(suffix))
+
+	cf.step("Mapping route %s.%s", host, domain.Name)
+	result := route{}
+	body := map[string]interface{}{
+		"host": host,
+		"relationships": map[string]interface{}{
+			"space":  toOne(cf.spaceGUID),
+			"domain": toOne(domain.GUID),
+		},
+	}
+	_, err = cf.do(ctx, "POST", "/v3/routes", body, &result)
+	if err != nil {
+		return err
+	}
+
+	body = map[string]interface{}{
+		"destinations": []interface{}{
+			map[string]interface{}{
+				"app": map[string]string{"guid": appGUID},
+			},
+		},
+	}
+	_, err = cf.do(ctx, "POST", fmt.Sprintf("/v3/routes/%s/destinations", result.GUID), body, nil)
+	return err
+}
+
+func (cf *CloudFoundry) getRoute(ctx context.Context, appGUID string) (route, bool, error) {
+	page := struct {
+		Resources []route
+	}{}
+	_, err := cf.do(ctx, "GET", fmt.Sprintf("/v3/apps/%s/routes", appGUID), nil, &page)
+	if err != nil || len(page.Resources) == 0 {
+		return route{}, false, err
+	}
+	return page.Resources[0], true, nil
+}
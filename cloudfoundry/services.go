@@ -0,0 +1,142 @@
+package cloudfoundry
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+type serviceInstance struct {
+	GUID          string
+	Name          string
+	LastOperation struct {
+		Type        string
+		State       string
+		Description string
+	} `json:"last_operation"`
+}
+
+func (cf *CloudFoundry) createServices(ctx context.Context, app models.App) error {
+	for _, service := range app.Services {
+		err := cf.createService(ctx, service)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cf *CloudFoundry) getService(ctx context.Context, name string) (serviceInstance, bool, error) {
+	instance := serviceInstance{}
+	found, err := cf.find(ctx, "/v3/service_instances", url.Values{
+		"names":       {name},
+		"space_guids": {cf.spaceGUID},
+	}, &instance)
+	return instance, found, err
+}
+
+// createService creates a managed service instance unless one with the same
+// name already exists, and waits for provisioning to finish
+func (cf *CloudFoundry) createService(ctx context.Context, service models.Service) error {
+	_, found, err := cf.getService(ctx, service.Name)
+	if err != nil {
+		return err
+	}
+	if found {
+		cf.logf("Using existing service %s", service.Name)
+		return nil
+	}
+
+	plan := resource{}
+	found, err = cf.find(ctx, "/v3/service_plans", url.Values{
+		"names":                  {service.Plan},
+		"service_offering_names": {service.Service},
+		"space_guids":            {cf.spaceGUID},
+	}, &plan)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Plan %s of service %s not found", service.Plan, service.Service)
+	}
+
+	body := map[string]interface{}{
+		"type": "managed",
+		"name": service.Name,
+		"relationships": map[string]interface{}{
+			"space":        toOne(cf.spaceGUID),
+			"service_plan": toOne(plan.GUID),
+		},
+	}
+	if len(service.Tags) > 0 {
+		body["tags"] = service.Tags
+	}
+	if len(service.Config) > 0 {
+		body["parameters"] = service.Config
+	}
+
+	cf.step("Creating service %s from plan %s of %s", service.Name, service.Plan, service.Service)
+	_, err = cf.do(ctx, "POST", "/v3/service_instances", body, nil)
+	if err != nil {
+		return err
+	}
+
+	return cf.checkService(ctx, service)
+}
+
+func (cf *CloudFoundry) checkService(ctx context.Context, service models.Service) error {
+	err := wait(ctx, cf.pollInterval, cf.serviceTimeout, func() (bool, error) {
+		instance, found, err := cf.getService(ctx, service.Name)
+		if err != nil || !found {
+			return false, err
+		}
+
+		switch instance.LastOperation.State {
+		case "succeeded":
+			cf.logf("Service %s is ready", service.Name)
+			return true, nil
+		case "failed":
+			return false, fmt.Errorf("Service %s failed: %s", service.Name, instance.LastOperation.Description)
+		}
+		return false, nil
+	})
+	if err == errTimeout {
+		return fmt.Errorf("Service %s incomplete", service.Name)
+	}
+	return err
+}
+
+func (cf *CloudFoundry) bindService(ctx context.Context, appGUID, name string) error {
+	instance, found, err := cf.getService(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Service %s not found", name)
+	}
+
+	binding := resource{}
+	found, err = cf.find(ctx, "/v3/service_credential_bindings", url.Values{
+		"app_guids":              {appGUID},
+		"service_instance_guids": {instance.GUID},
+	}, &binding)
+	if err != nil || found {
+		return err
+	}
+
+	cf.step("Binding service %s", name)
+	body := map[string]interface{}{
+		"type": "app",
+		"relationships": map[string]interface{}{
+			"app":              toOne(appGUID),
+			"service_instance": toOne(instance.GUID),
+		},
+	}
+	resp, err := cf.do(ctx, "POST", "/v3/service_credential_bindings", body, nil)
+	if err != nil {
+		return err
+	}
+	return cf.waitForJob(ctx, resp.Header.Get("Location"), cf.serviceTimeout)
+}
@@ -0,0 +1,64 @@
+package cloudfoundry
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+func (cf *CloudFoundry) getOrg(ctx context.Context, orgID string) (resource, error) {
+	org := resource{}
+	_, err := cf.do(ctx, "GET", fmt.Sprintf("/v3/organizations/%s", orgID), nil, &org)
+	return org, err
+}
+
+func (cf *CloudFoundry) getSpace(ctx context.Context, space string) (resource, bool, error) {
+	result := resource{}
+	found, err := cf.find(ctx, "/v3/spaces", url.Values{
+		"names":              {space},
+		"organization_guids": {cf.orgGUID},
+	}, &result)
+	return result, found, err
+}
+
+// createSpace creates the space if it doesn't exist and targets it
+func (cf *CloudFoundry) createSpace(ctx context.Context, space string) error {
+	result, found, err := cf.getSpace(ctx, space)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		cf.step("Using existing space %s", space)
+	} else {
+		cf.step("Creating space %s", space)
+		body := map[string]interface{}{
+			"name": space,
+			"relationships": map[string]interface{}{
+				"organization": toOne(cf.orgGUID),
+			},
+		}
+		_, err = cf.do(ctx, "POST", "/v3/spaces", body, &result)
+		if err != nil {
+			return err
+		}
+	}
+
+	cf.spaceGUID = result.GUID
+	return nil
+}
+
+// deleteSpace deletes the space and everything in it
+func (cf *CloudFoundry) deleteSpace(ctx context.Context, space string) error {
+	result, found, err := cf.getSpace(ctx, space)
+	if err != nil || !found {
+		return err
+	}
+
+	cf.step("Deleting space %s", space)
+	resp, err := cf.do(ctx, "DELETE", fmt.Sprintf("/v3/spaces/%s", result.GUID), nil, nil)
+	if err != nil {
+		return err
+	}
+	return cf.waitForJob(ctx, resp.Header.Get("Location"), cf.deleteTimeout)
+}
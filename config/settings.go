@@ -1,22 +1,121 @@
 package config
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
 type Settings struct {
-	Port           string `envconfig:"port" default:"3000"`
-	CFURL          string `envconfig:"cf_url" required:"true"`
-	CFUsername     string `envconfig:"cf_username" required:"true"`
-	CFPassword     string `envconfig:"cf_password" required:"true"`
-	BrokerUsername string `envconfig:"broker_username" required:"true"`
-	BrokerPassword string `envconfig:"broker_password" required:"true"`
-	DatabaseURL    string `envconfig:"database_url" required:"true"`
-	BaseURL        string `envconfig:"base_url" required:"true"`
+	Port            string        `envconfig:"port" default:"3000"`
+	CFURL           string        `envconfig:"cf_url" required:"true"`
+	CFUsername      string        `envconfig:"cf_username" required:"true"`
+	CFPassword      string        `envconfig:"cf_password" required:"true"`
+	CFPollInterval  time.Duration `envconfig:"cf_poll_interval" default:"5s"`
+	BrokerUsername  string        `envconfig:"broker_username" required:"true"`
+	BrokerPassword  string        `envconfig:"broker_password" required:"true"`
+	DatabaseURL     string        `envconfig:"database_url" required:"true"`
+	BaseURL         string        `envconfig:"base_url" required:"true"`
+	GitHubURL       string        `envconfig:"github_url" default:"https://api.github.com/"`
+	Workers         int           `envconfig:"workers" default:"4"`
+	JobPollInterval time.Duration `envconfig:"job_poll_interval" default:"5s"`
+	// Running jobs whose worker stops renewing them for JobLease, e.g.
+	// because the broker crashed, are claimed again
+	JobLease time.Duration `envconfig:"job_lease" default:"1m"`
+	// Webhook deliveries are remembered for DeliveryRetention, so that
+	// redeliveries aren't processed twice
+	DeliveryRetention     time.Duration `envconfig:"delivery_retention" default:"720h"`
+	DeliveryPruneInterval time.Duration `envconfig:"delivery_prune_interval" default:"1h"`
+	// A delivery still being handled after DeliveryClaimTimeout was
+	// abandoned, e.g. because the broker crashed, and is handled again
+	DeliveryClaimTimeout time.Duration `envconfig:"delivery_claim_timeout" default:"1m"`
+	// Webhook secrets older than SecretRotationInterval are rotated, unless
+	// it is zero. The previous secret is accepted for SecretGracePeriod.
+	SecretRotationInterval time.Duration `envconfig:"secret_rotation_interval" default:"2160h"`
+	SecretGracePeriod      time.Duration `envconfig:"secret_grace_period" default:"1h"`
+	SecretCheckInterval    time.Duration `envconfig:"secret_check_interval" default:"1h"`
+	// EncryptionKeys lists the keys that encrypt GitHub tokens and webhook
+	// secrets, as comma-separated `id:base64-key` pairs. Values are
+	// encrypted under EncryptionKeyID; the other keys decrypt older values.
+	EncryptionKeys  string `envconfig:"encryption_keys" required:"true"`
+	EncryptionKeyID string `envconfig:"encryption_key_id" required:"true"`
+	// GitHubAppID and GitHubAppPrivateKey, a PEM-encoded RSA key, let
+	// instances authenticate as an installation of the GitHub App instead
+	// of with a personal access token
+	GitHubAppID         int64  `envconfig:"github_app_id"`
+	GitHubAppPrivateKey string `envconfig:"github_app_private_key"`
+}
+
+// GitHubAppKey parses GitHubAppPrivateKey
+func (s Settings) GitHubAppKey() (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s.GitHubAppPrivateKey))
+	if block == nil {
+		return nil, errors.New("GitHub App private key must be PEM-encoded")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid GitHub App private key: %s", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("GitHub App private key must be an RSA key")
+	}
+	return key, nil
+}
+
+// EncryptionKeyMap parses EncryptionKeys
+func (s Settings) EncryptionKeyMap() (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for _, pair := range strings.Split(s.EncryptionKeys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Encryption keys must be id:base64-key pairs")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption key %s: %s", parts[0], err)
+		}
+		keys[parts[0]] = key
+	}
+	return keys, nil
 }
 
 func NewSettings() (Settings, error) {
 	settings := Settings{}
 	err := envconfig.Process("review-app", &settings)
-	return settings, err
+	if err != nil {
+		return settings, err
+	}
+
+	_, err = url.Parse(settings.GitHubURL)
+	if err != nil {
+		return settings, fmt.Errorf("Invalid GitHub URL: %s", err)
+	}
+
+	_, err = settings.EncryptionKeyMap()
+	if err != nil {
+		return settings, err
+	}
+
+	if settings.GitHubAppID != 0 {
+		_, err = settings.GitHubAppKey()
+		if err != nil {
+			return settings, err
+		}
+	}
+
+	return settings, nil
 }
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func encodePEM(blockType string, data []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}))
+}
+
+func TestGitHubAppKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		// GitHub issues PKCS #1 keys
+		{"pkcs1", encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), true},
+		{"pkcs8", encodePEM("PRIVATE KEY", pkcs8), true},
+		{"not pem", "not a key", false},
+		{"empty", "", false},
+		{"garbage", encodePEM("RSA PRIVATE KEY", []byte("garbage")), false},
+		{"ecdsa", encodePEM("PRIVATE KEY", ecPKCS8), false},
+	}
+
+	for _, test := range tests {
+		parsed, err := Settings{GitHubAppPrivateKey: test.key}.GitHubAppKey()
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", test.name, test.valid, err)
+			continue
+		}
+		if test.valid && parsed.N.Cmp(key.N) != 0 {
+			t.Errorf("%s: parsed a different key", test.name)
+		}
+	}
+}
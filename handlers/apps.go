@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+type AppHandler struct {
+	db *gorm.DB
+}
+
+func NewAppHandler(db *gorm.DB) AppHandler {
+	return AppHandler{db: db}
+}
+
+type AppStatus struct {
+	Number      int    `json:",omitempty"`
+	Branch      string `json:",omitempty"`
+	Sha         string
+	Space       string
+	Route       string
+	State       string
+	Error       string `json:",omitempty"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeployedAt  *time.Time `json:",omitempty"`
+	DestroyedAt *time.Time `json:",omitempty"`
+}
+
+func NewAppStatus(app models.ReviewApp) AppStatus {
+	return AppStatus{
+		Number:      app.Number,
+		Branch:      app.Branch,
+		Sha:         app.Sha,
+		Space:       app.Space,
+		Route:       app.Route,
+		State:       app.State,
+		Error:       app.Error,
+		CreatedAt:   app.CreatedAt,
+		UpdatedAt:   app.UpdatedAt,
+		DeployedAt:  app.DeployedAt,
+		DestroyedAt: app.DestroyedAt,
+	}
+}
+
+// List lists the review apps of a service instance
+func (h *AppHandler) List(res http.ResponseWriter, req *http.Request) {
+	instanceID := mux.Vars(req)["instance"]
+	if !h.instanceExists(res, instanceID) {
+		return
+	}
+
+	apps := []models.ReviewApp{}
+	err := h.db.Where(
+		models.ReviewApp{InstanceID: instanceID},
+	).Order("number").Find(&apps).Error
+	if err != nil {
+		writeError(res, http.StatusInternalServerError, "")
+		return
+	}
+
+	statuses := []AppStatus{}
+	for _, app := range apps {
+		statuses = append(statuses, NewAppStatus(app))
+	}
+	writeJSON(res, http.StatusOK, statuses)
+}
+
+// Get shows the review app of a pull request
+func (h *AppHandler) Get(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if !h.instanceExists(res, vars["instance"]) {
+		return
+	}
+
+	number, err := strconv.Atoi(vars["pr"])
+	if err != nil || number < 1 {
+		writeError(res, http.StatusNotFound, "")
+		return
+	}
+
+	app := models.ReviewApp{}
+	result := h.db.Where(
+		models.ReviewApp{InstanceID: vars["instance"], Number: number},
+	).Find(&app)
+	if result.RecordNotFound() {
+		writeError(res, http.StatusNotFound, "")
+		return
+	}
+	if result.Error != nil {
+		writeError(res, http.StatusInternalServerError, "")
+		return
+	}
+
+	writeJSON(res, http.StatusOK, NewAppStatus(app))
+}
+
+func (h *AppHandler) instanceExists(res http.ResponseWriter, instanceID string) bool {
+	result := h.db.Where(models.Hook{InstanceID: instanceID}).Find(&models.Hook{})
+	if result.RecordNotFound() {
+		writeError(res, http.StatusNotFound, "")
+		return false
+	}
+	if result.Error != nil {
+		writeError(res, http.StatusInternalServerError, "")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// BasicAuth wraps handler so that it requires the given credentials
+func BasicAuth(username, password string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		validUsername := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		validPassword := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !ok || !validUsername || !validPassword {
+			res.Header().Set("WWW-Authenticate", `Basic realm="review-app"`)
+			writeError(res, http.StatusUnauthorized, "")
+			return
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
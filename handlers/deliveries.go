@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// claimDelivery records a delivery as being handled. If the delivery was
+// recorded before, the boolean result is true and the earlier record is
+// returned instead, unless its handling was abandoned, in which case it is
+// claimed again.
+func (h *HookHandler) claimDelivery(instanceID, guid, event string) (models.Delivery, bool, error) {
+	delivery := models.Delivery{}
+	result := h.db.Raw(`
+		INSERT INTO deliveries (instance_id, guid, event, status, created_at, updated_at)
+		VALUES (?, ?, ?, 0, now(), now())
+		ON CONFLICT (instance_id, guid) DO NOTHING
+		RETURNING *
+	`, instanceID, guid, event).Scan(&delivery)
+	if !result.RecordNotFound() {
+		return delivery, false, result.Error
+	}
+
+	result = h.db.Raw(`
+		UPDATE deliveries
+		SET updated_at = now()
+		WHERE instance_id = ? AND guid = ? AND status = 0
+		AND updated_at < now() - ? * interval '1 second'
+		RETURNING *
+	`, instanceID, guid, h.settings.DeliveryClaimTimeout.Seconds()).Scan(&delivery)
+	if !result.RecordNotFound() {
+		return delivery, false, result.Error
+	}
+
+	err := h.db.Where(models.Delivery{InstanceID: instanceID, GUID: guid}).First(&delivery).Error
+	return delivery, true, err
+}
+
+// finishDelivery records the response to a delivery. A delivery that failed
+// with a server error is forgotten, so that a redelivery can try again.
+func (h *HookHandler) finishDelivery(delivery *models.Delivery, status int, response interface{}) error {
+	if status >= http.StatusInternalServerError {
+		return h.db.Delete(delivery).Error
+	}
+
+	delivery.Status = status
+	if response != nil {
+		body, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		delivery.Response = string(body)
+	}
+	if job, ok := response.(JobResponse); ok {
+		delivery.JobID = &job.JobID
+	}
+	return h.db.Save(delivery).Error
+}
+
+// replayDelivery answers a redelivery with the response to the original
+// delivery. If the delivery queued a job, the response shows how the job is
+// going.
+func (h *HookHandler) replayDelivery(res http.ResponseWriter, delivery models.Delivery) {
+	res.Header().Set("X-Review-App-Duplicate", "true")
+
+	if delivery.Status == 0 {
+		writeError(res, http.StatusConflict, "Delivery is being handled")
+		return
+	}
+
+	if delivery.JobID != nil {
+		job := models.Job{}
+		err := h.db.Where("id = ?", *delivery.JobID).First(&job).Error
+		if err != nil {
+			writeError(res, http.StatusInternalServerError, "")
+			return
+		}
+		writeJSON(res, delivery.Status, NewJobResponse(delivery.Status, job))
+		return
+	}
+
+	if delivery.Response == "" {
+		res.WriteHeader(delivery.Status)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(delivery.Status)
+	res.Write([]byte(delivery.Response))
+}
+
+// PruneDeliveries forgets deliveries older than the retention period, every
+// prune interval until ctx is cancelled
+func (h *HookHandler) PruneDeliveries(ctx context.Context, logger lager.Logger) {
+	logger = logger.Session("prune-deliveries")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(h.settings.DeliveryPruneInterval):
+		}
+
+		cutoff := time.Now().Add(-h.settings.DeliveryRetention)
+		result := h.db.Where("created_at < ?", cutoff).Delete(&models.Delivery{})
+		if result.Error != nil {
+			logger.Error("delete", result.Error)
+			continue
+		}
+		logger.Info("deleted", lager.Data{"count": result.RowsAffected})
+	}
+}
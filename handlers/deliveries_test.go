@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/testenv"
+)
+
+// abandon ages the claim on a delivery past the claim timeout
+func (e *testEnv) abandon(t *testing.T, guid string) {
+	err := e.DB.Exec(
+		"UPDATE deliveries SET updated_at = now() - interval '1 hour' WHERE guid = ?", guid,
+	).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) claim(t *testing.T, guid string, expectDuplicate bool) models.Delivery {
+	delivery, duplicate, err := e.handler.claimDelivery("instance", guid, "pull_request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate != expectDuplicate {
+		t.Fatalf("Expected duplicate %t, got %t for %+v", expectDuplicate, duplicate, delivery)
+	}
+	return delivery
+}
+
+func TestClaimDelivery(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	first := env.claim(t, "delivery-1", false)
+	again := env.claim(t, "delivery-1", true)
+	if again.ID != first.ID || again.Status != 0 {
+		t.Errorf("Expected the claim %+v, got %+v", first, again)
+	}
+	env.claim(t, "delivery-2", false)
+
+	// A claim that outlives the timeout was abandoned by a broker that
+	// crashed, and is taken over
+	env.abandon(t, "delivery-1")
+	reclaimed := env.claim(t, "delivery-1", false)
+	if reclaimed.ID != first.ID {
+		t.Errorf("Expected delivery %d to be claimed again, got %d", first.ID, reclaimed.ID)
+	}
+	env.claim(t, "delivery-1", true)
+}
+
+func TestClaimFinishedDelivery(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Answered deliveries are never claimed again, however old
+	delivery := env.claim(t, "delivery-1", false)
+	err := env.handler.finishDelivery(&delivery, http.StatusAccepted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.abandon(t, "delivery-1")
+	finished := env.claim(t, "delivery-1", true)
+	if finished.Status != http.StatusAccepted {
+		t.Errorf("Expected status %d, got %d", http.StatusAccepted, finished.Status)
+	}
+
+	// Deliveries that failed are forgotten, so that a redelivery can retry
+	failed := env.claim(t, "delivery-2", false)
+	err = env.handler.finishDelivery(&failed, http.StatusInternalServerError, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.claim(t, "delivery-2", false)
+}
+
+func TestHandleAbandonedDelivery(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// A delivery claimed by a broker that crashed before answering it
+	err := env.DB.Exec(`
+		INSERT INTO deliveries (instance_id, guid, event, status, created_at, updated_at)
+		VALUES ('instance', 'delivery-1', 'pull_request', 0, now(), now() - interval '1 hour')
+	`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := env.deliver("delivery-1", testenv.Secret, testPayload)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, res.Code, res.Body)
+	}
+	if res.Header().Get("X-Review-App-Duplicate") != "" {
+		t.Error("Expected the abandoned delivery to be handled again")
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/url"
+
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/webhooks"
+)
+
+// eventHandler queues and processes deliveries of one type of GitHub event
+type eventHandler interface {
+	// job returns the job that processes a delivery. The boolean result is
+	// false if the delivery needs no processing.
+	job(hook models.Hook, payload []byte) (models.Job, bool, error)
+	// process runs a queued job
+	process(ctx context.Context, h *HookHandler, hook models.Hook, payload []byte) error
+}
+
+// eventHandlers maps the X-GitHub-Event header to the handler of the event.
+// Other events, except for ping, are ignored.
+var eventHandlers = map[string]eventHandler{
+	"pull_request":  pullRequestEvent{},
+	"issue_comment": issueCommentEvent{},
+	"push":          pushEvent{},
+}
+
+// rejectedError refuses a delivery that is valid but can't be processed
+type rejectedError struct {
+	message string
+}
+
+func (e *rejectedError) Error() string {
+	return e.message
+}
+
+type pullRequestEvent struct{}
+
+func (pullRequestEvent) job(hook models.Hook, payload []byte) (models.Job, bool, error) {
+	pull := webhooks.PullPayload{}
+	err := json.Unmarshal(payload, &pull)
+	if err != nil {
+		return models.Job{}, false, err
+	}
+
+	switch pull.Action {
+	case "opened", "reopened", "synchronize", "labeled", "unlabeled", "closed":
+	default:
+		return models.Job{}, false, nil
+	}
+
+	if pull.IsFork() && !hook.ForkDeploys {
+		return models.Job{}, false, &rejectedError{"Cannot deploy from fork"}
+	}
+
+	// A teardown must run even if a newer commit is pushed, since the job
+	// for that commit won't deploy once the pull request is closed or its
+	// label removed, so only deploys have a pull request number
+	job := models.Job{Sha: pull.PullRequest.Head.Sha}
+	if pull.Action != "closed" && pull.Action != "unlabeled" {
+		job.Number = pull.Number
+	}
+	return job, true, nil
+}
+
+func (pullRequestEvent) process(ctx context.Context, h *HookHandler, hook models.Hook, payload []byte) error {
+	pull := webhooks.PullPayload{}
+	err := json.Unmarshal(payload, &pull)
+	if err != nil {
+		return err
+	}
+	return h.handleHook(ctx, pull, hook)
+}
+
+type issueCommentEvent struct{}
+
+func (issueCommentEvent) job(hook models.Hook, payload []byte) (models.Job, bool, error) {
+	comment := webhooks.CommentPayload{}
+	err := json.Unmarshal(payload, &comment)
+	if err != nil {
+		return models.Job{}, false, err
+	}
+
+	// Commands don't supersede deploys, so the job has no pull request
+	// number
+	_, ok := comment.Command()
+	return models.Job{}, ok, nil
+}
+
+func (issueCommentEvent) process(ctx context.Context, h *HookHandler, hook models.Hook, payload []byte) error {
+	comment := webhooks.CommentPayload{}
+	err := json.Unmarshal(payload, &comment)
+	if err != nil {
+		return err
+	}
+	return h.pullHandler(hook).Command(ctx, hook, comment)
+}
+
+type pushEvent struct{}
+
+func (pushEvent) job(hook models.Hook, payload []byte) (models.Job, bool, error) {
+	push := webhooks.PushPayload{}
+	err := json.Unmarshal(payload, &push)
+	if err != nil {
+		return models.Job{}, false, err
+	}
+
+	branch, ok := push.Branch()
+	if !ok || !webhooks.MatchesBranch(hook, branch) {
+		return models.Job{}, false, nil
+	}
+
+	// As with pull requests, deleting a branch isn't superseded
+	if push.Deleted {
+		return models.Job{Sha: push.After}, true, nil
+	}
+	return models.Job{Branch: branch, Sha: push.After}, true, nil
+}
+
+func (pushEvent) process(ctx context.Context, h *HookHandler, hook models.Hook, payload []byte) error {
+	push := webhooks.PushPayload{}
+	err := json.Unmarshal(payload, &push)
+	if err != nil {
+		return err
+	}
+	return h.pullHandler(hook).Push(ctx, hook, push)
+}
+
+// https://developer.github.com/webhooks/#ping-event
+type pingPayload struct {
+	Zen    string
+	HookID int64 `json:"hook_id"`
+}
+
+// deliveryPayload returns the JSON payload of a delivery, which GitHub sends
+// as the body or, if the hook's content type is form, as the payload field of
+// a form
+func deliveryPayload(contentType string, body []byte) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/x-www-form-urlencoded" {
+		return body, nil
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	payload := values.Get("payload")
+	if payload == "" {
+		return nil, errors.New("Missing payload")
+	}
+	return []byte(payload), nil
+}
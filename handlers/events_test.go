@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+func pullPayload(action string) []byte {
+	return []byte(fmt.Sprintf(`{
+  "action": %q,
+  "number": 1,
+  "pull_request": {
+    "head": {"sha": "abc1234", "repo": {"full_name": "owner/repo"}},
+    "base": {"repo": {"full_name": "owner/repo"}}
+  }
+}`, action))
+}
+
+func TestPullRequestJob(t *testing.T) {
+	tests := []struct {
+		action string
+		queued bool
+		number int
+	}{
+		{"opened", true, 1},
+		{"reopened", true, 1},
+		{"synchronize", true, 1},
+		{"labeled", true, 1},
+		// Teardowns can't be superseded
+		{"unlabeled", true, 0},
+		{"closed", true, 0},
+		{"edited", false, 0},
+	}
+
+	for _, test := range tests {
+		job, ok, err := pullRequestEvent{}.job(models.Hook{}, pullPayload(test.action))
+		if err != nil {
+			t.Fatalf("%s: %s", test.action, err)
+		}
+		if ok != test.queued {
+			t.Errorf("%s: expected queued %t, got %t", test.action, test.queued, ok)
+		}
+		if ok && (job.Number != test.number || job.Sha != "abc1234") {
+			t.Errorf("%s: unexpected job %+v", test.action, job)
+		}
+	}
+}
+
+func TestPushJob(t *testing.T) {
+	hook := models.Hook{Branches: "feature/*"}
+	tests := []struct {
+		name    string
+		payload string
+		queued  bool
+		branch  string
+	}{
+		{"push", `{"ref": "refs/heads/feature/a", "after": "abc1234"}`, true, "feature/a"},
+		{"delete", `{"ref": "refs/heads/feature/a", "after": "0000000000000000000000000000000000000000", "deleted": true}`, true, ""},
+		{"unmatched", `{"ref": "refs/heads/main", "after": "abc1234"}`, false, ""},
+		{"tag", `{"ref": "refs/tags/feature/a", "after": "abc1234"}`, false, ""},
+	}
+
+	for _, test := range tests {
+		job, ok, err := pushEvent{}.job(hook, []byte(test.payload))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if ok != test.queued {
+			t.Errorf("%s: expected queued %t, got %t", test.name, test.queued, ok)
+		}
+		if job.Branch != test.branch || job.Number != 0 {
+			t.Errorf("%s: unexpected job %+v", test.name, job)
+		}
+	}
+}
+
+func TestDeliveryPayload(t *testing.T) {
+	const payload = `{"action": "opened", "title": "a&b=c"}`
+	form := url.Values{"payload": {payload}}.Encode()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		valid       bool
+	}{
+		{"json", "application/json", payload, true},
+		{"json with charset", "application/json; charset=utf-8", payload, true},
+		{"no content type", "", payload, true},
+		{"form", "application/x-www-form-urlencoded", form, true},
+		{"form with charset", "application/x-www-form-urlencoded; charset=utf-8", form, true},
+		{"form without payload", "application/x-www-form-urlencoded", "other=value", false},
+		{"empty form", "application/x-www-form-urlencoded", "", false},
+		{"malformed form", "application/x-www-form-urlencoded", "payload=%zz", false},
+	}
+
+	for _, test := range tests {
+		result, err := deliveryPayload(test.contentType, []byte(test.body))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", test.name, test.valid, err)
+			continue
+		}
+		if test.valid && string(result) != payload {
+			t.Errorf("%s: expected %s, got %s", test.name, payload, result)
+		}
+	}
+}
@@ -1,17 +1,20 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
-	"github.com/google/go-github/github"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
-	"golang.org/x/oauth2"
 
 	"github.com/jmcarp/cf-review-app/cloudfoundry"
 	"github.com/jmcarp/cf-review-app/config"
+	"github.com/jmcarp/cf-review-app/jobs"
+	"github.com/jmcarp/cf-review-app/locks"
 	"github.com/jmcarp/cf-review-app/models"
 	"github.com/jmcarp/cf-review-app/utils"
 	"github.com/jmcarp/cf-review-app/webhooks"
@@ -19,13 +22,17 @@ import (
 
 type HookHandler struct {
 	db       *gorm.DB
+	queue    *jobs.Queue
+	locker   *locks.Locker
 	settings config.Settings
 }
 
-func NewHookHandler(db *gorm.DB, settings config.Settings) HookHandler {
-	return HookHandler{db: db, settings: settings}
+func NewHookHandler(db *gorm.DB, queue *jobs.Queue, locker *locks.Locker, settings config.Settings) HookHandler {
+	return HookHandler{db: db, queue: queue, locker: locker, settings: settings}
 }
 
+// Handle verifies a webhook delivery and queues it for processing, routing
+// it by its X-GitHub-Event header
 func (h *HookHandler) Handle(res http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -33,13 +40,6 @@ func (h *HookHandler) Handle(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	payload := webhooks.PullPayload{}
-	err = json.Unmarshal(body, &payload)
-	if err != nil {
-		writeError(res, http.StatusBadRequest, "Invalid payload")
-		return
-	}
-
 	hook := models.Hook{}
 	result := h.db.Where(
 		models.Hook{InstanceID: mux.Vars(req)["instance"]},
@@ -53,59 +53,240 @@ func (h *HookHandler) Handle(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	signature := req.Header.Get("X-Hub-Signature")
-	signed := utils.CheckSignature([]byte(hook.Secret), body, signature)
-	if !signed {
-		writeError(res, http.StatusUnauthorized, "Invalid signature")
+	// The signature covers the body as sent, even if it is a form, and is
+	// checked before the delivery is recorded
+	err = h.checkSignature(hook, req, body)
+	if err != nil {
+		h.countSignatureFailure(hook)
+		writeError(res, http.StatusUnauthorized, err.Error())
 		return
 	}
 
-	if payload.IsFork() {
-		writeError(res, http.StatusBadRequest, "Cannot deploy from fork")
+	event := req.Header.Get("X-GitHub-Event")
+
+	// GitHub redelivers webhooks, so a delivery seen before gets the
+	// response it was first given instead of being processed again
+	deliveryID := req.Header.Get("X-GitHub-Delivery")
+	if deliveryID == "" {
+		status, response := h.dispatch(hook, event, req.Header.Get("Content-Type"), body)
+		writeResponse(res, status, response)
 		return
 	}
 
-	err = h.handleHook(payload, hook)
+	delivery, duplicate, err := h.claimDelivery(hook.InstanceID, deliveryID, event)
 	if err != nil {
 		writeError(res, http.StatusInternalServerError, "")
+		return
+	}
+	if duplicate {
+		h.replayDelivery(res, delivery)
+		return
+	}
+
+	status, response := h.dispatch(hook, event, req.Header.Get("Content-Type"), body)
+	err = h.finishDelivery(&delivery, status, response)
+	if err != nil {
+		writeError(res, http.StatusInternalServerError, "")
+		return
+	}
+	writeResponse(res, status, response)
+}
+
+// checkSignature verifies a delivery with the hook's secret, or with its
+// previous secret during the grace period after the secret is rotated
+func (h *HookHandler) checkSignature(hook models.Hook, req *http.Request, body []byte) error {
+	check := func(secret string) error {
+		return utils.CheckSignature(
+			[]byte(secret), body,
+			req.Header.Get("X-Hub-Signature"),
+			req.Header.Get("X-Hub-Signature-256"),
+			hook.RequireSHA256,
+		)
+	}
+
+	err := check(string(hook.Secret))
+	if err == utils.ErrInvalidSignature && hook.AcceptsPreviousSecret(time.Now(), h.settings.SecretGracePeriod) {
+		return check(string(hook.PreviousSecret))
+	}
+	return err
+}
+
+// countSignatureFailure counts a delivery to hook with a bad signature. The
+// count is shown in the instance status, since repeated failures mean the
+// secret is out of sync or someone is forging deliveries.
+func (h *HookHandler) countSignatureFailure(hook models.Hook) {
+	h.db.Model(&hook).UpdateColumn(
+		"signature_failures", gorm.Expr("signature_failures + 1"),
+	)
+}
+
+// dispatch queues a verified delivery for the handler of its event and
+// returns the response to it. The response is nil if it has no body.
+func (h *HookHandler) dispatch(hook models.Hook, event, contentType string, body []byte) (int, interface{}) {
+	payload, err := deliveryPayload(contentType, body)
+	if err != nil {
+		return http.StatusBadRequest, newHTTPError(http.StatusBadRequest, "Invalid payload")
+	}
+
+	if event == "ping" {
+		ping := pingPayload{}
+		err = json.Unmarshal(payload, &ping)
+		if err != nil {
+			return http.StatusBadRequest, newHTTPError(http.StatusBadRequest, "Invalid payload")
+		}
+		return http.StatusOK, PingResponse{
+			Status: http.StatusOK,
+			HookID: ping.HookID,
+			Zen:    ping.Zen,
+		}
+	}
+
+	handler, ok := eventHandlers[event]
+	if !ok {
+		return http.StatusNoContent, nil
+	}
+
+	job, ok, err := handler.job(hook, payload)
+	if rejected, isRejected := err.(*rejectedError); isRejected {
+		return http.StatusBadRequest, newHTTPError(http.StatusBadRequest, rejected.message)
+	}
+	if err != nil {
+		return http.StatusBadRequest, newHTTPError(http.StatusBadRequest, "Invalid payload")
+	}
+	if !ok {
+		return http.StatusNoContent, nil
 	}
+
+	job.InstanceID = hook.InstanceID
+	job.Event = event
+	job.Payload = string(payload)
+	job, err = h.queue.Enqueue(job)
+	if err != nil {
+		return http.StatusInternalServerError, newHTTPError(http.StatusInternalServerError, "")
+	}
+
+	return http.StatusAccepted, NewJobResponse(http.StatusAccepted, job)
 }
 
-func (h *HookHandler) handleHook(payload webhooks.PullPayload, hook models.Hook) error {
-	handler := webhooks.NewPullHandler(
-		github.NewClient(
-			oauth2.NewClient(oauth2.NoContext,
-				oauth2.StaticTokenSource(
-					&oauth2.Token{AccessToken: hook.Token},
-				),
-			),
-		),
-		cloudfoundry.NewCloudFoundry(
-			h.settings.CFURL,
-			h.settings.CFUsername,
-			h.settings.CFPassword,
-		),
+// Process runs a queued webhook delivery
+func (h *HookHandler) Process(ctx context.Context, job models.Job) error {
+	hook := models.Hook{}
+	err := h.db.Where(models.Hook{InstanceID: job.InstanceID}).Find(&hook).Error
+	if err != nil {
+		return err
+	}
+
+	handler, ok := eventHandlers[job.Event]
+	if !ok {
+		return fmt.Errorf("Unknown event %s", job.Event)
+	}
+	return handler.process(ctx, h, hook, []byte(job.Payload))
+}
+
+func (h *HookHandler) pullHandler(hook models.Hook) *webhooks.PullHandler {
+	cfClient := cloudfoundry.NewCloudFoundry(
+		h.settings.CFURL,
+		h.settings.CFUsername,
+		h.settings.CFPassword,
+	)
+	cfClient.SetPollInterval(h.settings.CFPollInterval)
+
+	return webhooks.NewPullHandler(
+		webhooks.NewGitHubClient(webhooks.Auth(hook, h.settings), h.settings),
+		cfClient,
+		h.locker,
+		h.db,
+		h.settings,
 	)
+}
+
+func (h *HookHandler) handleHook(ctx context.Context, payload webhooks.PullPayload, hook models.Hook) error {
+	handler := h.pullHandler(hook)
+
+	open := handler.Open
+	if payload.IsFork() {
+		open = handler.OpenFork
+	}
 
 	switch payload.Action {
 	case "opened", "reopened", "synchronize":
-		return handler.Open(hook.OrgID, payload)
+		if webhooks.ShouldDeploy(hook, payload) {
+			return open(ctx, hook, payload)
+		}
+	// Labels on closed pull requests don't deploy them, and their review
+	// apps were torn down when they were closed
+	case "labeled":
+		if payload.PullRequest.State != "open" {
+			return nil
+		}
+		if webhooks.IsForkApproval(hook, payload) {
+			return handler.Approve(ctx, hook, payload)
+		}
+		if webhooks.IsDeployLabel(hook, payload.Label) {
+			return open(ctx, hook, payload)
+		}
+	case "unlabeled":
+		if payload.PullRequest.State != "open" {
+			return nil
+		}
+		if webhooks.IsDeployLabel(hook, payload.Label) {
+			return handler.Close(ctx, hook, payload)
+		}
 	case "closed":
-		return handler.Close(hook.OrgID, payload)
+		return handler.Close(ctx, hook, payload)
 	}
 	return nil
 }
 
+type JobResponse struct {
+	Status int
+	JobID  uint
+	State  string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+func NewJobResponse(status int, job models.Job) JobResponse {
+	return JobResponse{
+		Status: status,
+		JobID:  job.ID,
+		State:  job.State,
+		Error:  job.Error,
+	}
+}
+
+type PingResponse struct {
+	Status int
+	HookID int64
+	Zen    string `json:",omitempty"`
+}
+
 type HTTPError struct {
 	Status  int
 	Message string `json:",omitempty"`
 }
 
-func writeError(res http.ResponseWriter, status int, message string) {
-	res.WriteHeader(status)
-	httpError := HTTPError{
+func newHTTPError(status int, message string) HTTPError {
+	return HTTPError{
 		Status:  status,
 		Message: message,
 	}
-	json.NewEncoder(res).Encode(httpError)
+}
+
+func writeError(res http.ResponseWriter, status int, message string) {
+	writeJSON(res, status, newHTTPError(status, message))
+}
+
+// writeResponse writes body as JSON, or no body if it is nil
+func writeResponse(res http.ResponseWriter, status int, body interface{}) {
+	if body == nil {
+		res.WriteHeader(status)
+		return
+	}
+	writeJSON(res, status, body)
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(body)
 }
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jmcarp/cf-review-app/jobs"
+	"github.com/jmcarp/cf-review-app/locks"
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/testenv"
+)
+
+const testPayload = `{
+  "action": "opened",
+  "number": 1,
+  "pull_request": {
+    "state": "open",
+    "head": {
+      "sha": "0123456789abcdef0123456789abcdef01234567",
+      "repo": {"name": "repo", "full_name": "owner/repo", "owner": {"login": "owner"}}
+    },
+    "base": {
+      "sha": "89abcdef0123456789abcdef0123456789abcdef",
+      "repo": {"name": "repo", "full_name": "owner/repo", "owner": {"login": "owner"}}
+    }
+  },
+  "sender": {"login": "author"}
+}`
+
+// testEnv serves webhook deliveries for a hook on owner/repo
+type testEnv struct {
+	*testenv.Env
+	queue   *jobs.Queue
+	handler HookHandler
+	router  *mux.Router
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	env := testenv.New(t)
+	hook := env.Hook()
+	err := env.DB.Create(&hook).Error
+	if err != nil {
+		env.Close()
+		t.Fatal(err)
+	}
+
+	queue := jobs.NewQueue(env.DB, env.Settings.JobLease)
+	handler := NewHookHandler(env.DB, queue, locks.NewLocker(env.DB.DB()), env.Settings)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/hook/{instance}", handler.Handle).Methods("POST")
+
+	return &testEnv{
+		Env:     env,
+		queue:   queue,
+		handler: handler,
+		router:  router,
+	}
+}
+
+// deliver posts a pull_request delivery signed with secret
+func (e *testEnv) deliver(deliveryID, secret, payload string) *httptest.ResponseRecorder {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+
+	req := httptest.NewRequest("POST", "/hook/instance", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "pull_request")
+	req.Header.Set("X-GitHub-Delivery", deliveryID)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	res := httptest.NewRecorder()
+	e.router.ServeHTTP(res, req)
+	return res
+}
+
+func TestHandle(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	res := env.deliver("delivery-1", testenv.Secret, testPayload)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, res.Code, res.Body)
+	}
+	response := JobResponse{}
+	err := json.Unmarshal(res.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, ok, err := env.queue.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || job.ID != response.JobID {
+		t.Fatalf("Expected job %d to be queued, got %+v", response.JobID, job)
+	}
+	if job.Number != 1 || job.Sha != testenv.Sha {
+		t.Errorf("Unexpected job %+v", job)
+	}
+
+	err = env.handler.Process(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := env.GitHub.Deployments("owner", "repo")
+	if len(deployments) != 1 {
+		t.Fatalf("Expected one deployment, got %d", len(deployments))
+	}
+	states := env.GitHub.States(deployments[0].ID)
+	if expected := []string{"queued", "in_progress", "success"}; !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected statuses %v, got %v", expected, states)
+	}
+
+	space, ok := env.CF.Space(env.OrgGUID, "owner-repo-pull-1")
+	if !ok {
+		t.Fatal("Space was not created")
+	}
+	if apps := env.CF.Apps(space.GUID); len(apps) != 1 || !apps[0].Started {
+		t.Errorf("Expected a started app, got %+v", apps)
+	}
+}
+
+func TestHandleBadSignature(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	res := env.deliver("delivery-1", "wrong-secret", testPayload)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+
+	_, ok, err := env.queue.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("Expected no job to be queued")
+	}
+
+	hook := models.Hook{}
+	err = env.DB.Where(models.Hook{InstanceID: "instance"}).First(&hook).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook.SignatureFailures != 1 {
+		t.Errorf("Expected one signature failure, got %d", hook.SignatureFailures)
+	}
+}
+
+func TestHandleRedelivery(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	first := env.deliver("delivery-1", testenv.Secret, testPayload)
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, first.Code, first.Body)
+	}
+	second := env.deliver("delivery-1", testenv.Secret, testPayload)
+	if second.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, second.Code, second.Body)
+	}
+	if second.Header().Get("X-Review-App-Duplicate") != "true" {
+		t.Error("Expected the redelivery to be marked as a duplicate")
+	}
+
+	count := 0
+	err := env.DB.Model(&models.Job{}).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected one job, got %d", count)
+	}
+}
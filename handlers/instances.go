@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/webhooks"
+)
+
+type InstanceHandler struct {
+	db          *gorm.DB
+	hookManager webhooks.HookManager
+}
+
+func NewInstanceHandler(db *gorm.DB, hookManager webhooks.HookManager) InstanceHandler {
+	return InstanceHandler{db: db, hookManager: hookManager}
+}
+
+type InstanceStatus struct {
+	Owner             string
+	Repo              string
+	HookID            int64
+	RequireSHA256     bool
+	SignatureFailures int
+	SecretRotatedAt   *time.Time `json:",omitempty"`
+}
+
+func NewInstanceStatus(hook models.Hook) InstanceStatus {
+	return InstanceStatus{
+		Owner:             hook.Owner,
+		Repo:              hook.Repo,
+		HookID:            hook.HookID,
+		RequireSHA256:     hook.RequireSHA256,
+		SignatureFailures: hook.SignatureFailures,
+		SecretRotatedAt:   hook.SecretRotatedAt,
+	}
+}
+
+// Get shows the webhook of a service instance
+func (h *InstanceHandler) Get(res http.ResponseWriter, req *http.Request) {
+	hook := models.Hook{}
+	result := h.db.Where(
+		models.Hook{InstanceID: mux.Vars(req)["instance"]},
+	).Find(&hook)
+	if result.RecordNotFound() {
+		writeError(res, http.StatusNotFound, "")
+		return
+	}
+	if result.Error != nil {
+		writeError(res, http.StatusInternalServerError, "")
+		return
+	}
+
+	writeJSON(res, http.StatusOK, NewInstanceStatus(hook))
+}
+
+// RotateSecret replaces the webhook secret of a service instance. The old
+// secret is accepted for the grace period.
+func (h *InstanceHandler) RotateSecret(res http.ResponseWriter, req *http.Request) {
+	instanceID := mux.Vars(req)["instance"]
+	result := h.db.Where(models.Hook{InstanceID: instanceID}).Find(&models.Hook{})
+	if result.RecordNotFound() {
+		writeError(res, http.StatusNotFound, "")
+		return
+	}
+	if result.Error != nil {
+		writeError(res, http.StatusInternalServerError, "")
+		return
+	}
+
+	hook, err := h.hookManager.Rotate(instanceID)
+	if err == webhooks.ErrRotationPending {
+		writeError(res, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(res, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(res, http.StatusOK, NewInstanceStatus(hook))
+}
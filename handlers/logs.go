@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+type LogHandler struct {
+	db *gorm.DB
+}
+
+func NewLogHandler(db *gorm.DB) LogHandler {
+	return LogHandler{db: db}
+}
+
+// Get shows the output of a deployment. GitHub links to it from the
+// deployment status, so it is authorized by the token in the link rather
+// than by broker credentials.
+func (h *LogHandler) Get(res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		writeError(res, http.StatusNotFound, "")
+		return
+	}
+
+	deployment := models.Deployment{}
+	result := h.db.Where("id = ?", id).First(&deployment)
+	if result.RecordNotFound() {
+		writeError(res, http.StatusNotFound, "")
+		return
+	}
+	if result.Error != nil {
+		writeError(res, http.StatusInternalServerError, "")
+		return
+	}
+
+	token := req.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(deployment.LogToken)) != 1 {
+		writeError(res, http.StatusNotFound, "")
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(http.StatusOK)
+	io.WriteString(res, deployment.Log)
+}
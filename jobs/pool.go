@@ -0,0 +1,149 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// Runner processes a job. The context is cancelled if the job is superseded
+// while it runs.
+type Runner func(ctx context.Context, job models.Job) error
+
+// Pool runs queued jobs on a fixed number of workers
+type Pool struct {
+	queue    *Queue
+	runner   Runner
+	workers  int
+	interval time.Duration
+	logger   lager.Logger
+}
+
+func NewPool(queue *Queue, runner Runner, workers int, interval time.Duration, logger lager.Logger) *Pool {
+	return &Pool{
+		queue:    queue,
+		runner:   runner,
+		workers:  workers,
+		interval: interval,
+		logger:   logger.Session("jobs"),
+	}
+}
+
+// Run starts the workers and blocks until ctx is cancelled and every
+// running job has finished
+func (p *Pool) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, ok, err := p.queue.Claim()
+		if err != nil {
+			p.logger.Error("claim", err)
+		}
+		if ok {
+			p.run(job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+func (p *Pool) run(job models.Job) {
+	logger := p.logger.Session("run", lager.Data{
+		"job":      job.ID,
+		"instance": job.InstanceID,
+		"event":    job.Event,
+	})
+
+	superseded, err := p.queue.Superseded(job)
+	if err != nil {
+		logger.Error("superseded", err)
+	}
+
+	if superseded {
+		logger.Info("superseded")
+		err = models.ErrSuperseded
+	} else {
+		logger.Info("start")
+		err = p.runWatched(job)
+		if err == models.ErrSuperseded {
+			logger.Info("superseded")
+		} else if err != nil {
+			logger.Error("failed", err)
+		}
+	}
+
+	if err == errLeaseLost {
+		logger.Info("lease-lost")
+		return
+	}
+
+	err = p.queue.Finish(job, err)
+	if err != nil {
+		logger.Error("finish", err)
+	}
+}
+
+// runWatched runs a job, renewing its lease while it runs. The job is
+// cancelled if a newer commit is queued for the same pull request, or if
+// its lease is lost, in the meantime.
+func (p *Pool) runWatched(job models.Job) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.interval):
+			}
+
+			renewed, err := p.queue.Renew(job)
+			if err != nil {
+				p.logger.Error("renew", err)
+			} else if !renewed {
+				stopped <- errLeaseLost
+				cancel()
+				return
+			}
+
+			ok, err := p.queue.Superseded(job)
+			if err != nil {
+				p.logger.Error("superseded", err)
+			}
+			if ok {
+				stopped <- models.ErrSuperseded
+				cancel()
+				return
+			}
+		}
+	}()
+
+	err := p.runner(ctx, job)
+	select {
+	case err := <-stopped:
+		return err
+	default:
+		return err
+	}
+}
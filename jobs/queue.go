@@ -0,0 +1,106 @@
+package jobs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// errLeaseLost is the result of a job that was claimed again by another
+// worker while it ran
+var errLeaseLost = errors.New("Lease on job lost")
+
+type Queue struct {
+	db    *gorm.DB
+	lease time.Duration
+}
+
+// NewQueue creates a queue whose running jobs are claimed again if their
+// worker doesn't renew its lease on them for lease, e.g. because the broker
+// crashed or was redeployed
+func NewQueue(db *gorm.DB, lease time.Duration) *Queue {
+	return &Queue{db: db, lease: lease}
+}
+
+// Enqueue stores a pending job for a webhook delivery
+func (q *Queue) Enqueue(job models.Job) (models.Job, error) {
+	job.State = models.JobPending
+	err := q.db.Create(&job).Error
+	return job, err
+}
+
+// Claim marks the oldest pending job, or running job whose lease has
+// expired, as running and returns it. Rows locked by other workers are
+// skipped, so several broker instances can share the same queue. The
+// boolean result is false if no job is pending.
+func (q *Queue) Claim() (models.Job, bool, error) {
+	job := models.Job{}
+	result := q.db.Raw(`
+		UPDATE jobs
+		SET state = ?, attempts = attempts + 1, started_at = now(), claimed_at = now(), updated_at = now()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE state = ? OR (state = ? AND claimed_at < now() - ? * interval '1 second')
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`, models.JobRunning, models.JobPending, models.JobRunning, q.lease.Seconds()).Scan(&job)
+	if result.RecordNotFound() {
+		return job, false, nil
+	}
+	if result.Error != nil {
+		return job, false, result.Error
+	}
+	return job, true, nil
+}
+
+// Superseded reports whether a newer job was queued for a different commit
+// on the same pull request or branch. Jobs without a pull request number or
+// branch, such as teardowns and commands, are never superseded.
+func (q *Queue) Superseded(job models.Job) (bool, error) {
+	if job.Number == 0 && job.Branch == "" {
+		return false, nil
+	}
+
+	count := 0
+	err := q.db.Model(&models.Job{}).Where(
+		"instance_id = ? AND number = ? AND branch = ? AND sha != ? AND id > ?",
+		job.InstanceID, job.Number, job.Branch, job.Sha, job.ID,
+	).Count(&count).Error
+	return count > 0, err
+}
+
+// Renew extends the lease on a running job. The result is false if the job
+// was claimed again in the meantime, in which case the caller must stop
+// running it.
+func (q *Queue) Renew(job models.Job) (bool, error) {
+	result := q.db.Model(&models.Job{}).Where(
+		"id = ? AND state = ? AND attempts = ?", job.ID, models.JobRunning, job.Attempts,
+	).UpdateColumn("claimed_at", gorm.Expr("now()"))
+	return result.RowsAffected > 0, result.Error
+}
+
+// Finish records the result of running a job, unless the job was claimed
+// again in the meantime
+func (q *Queue) Finish(job models.Job, jobErr error) error {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"state":       models.JobSucceeded,
+		"error":       "",
+		"finished_at": &now,
+	}
+	if jobErr == models.ErrSuperseded {
+		updates["state"] = models.JobSuperseded
+	} else if jobErr != nil {
+		updates["state"] = models.JobFailed
+		updates["error"] = jobErr.Error()
+	}
+	return q.db.Model(&models.Job{}).Where(
+		"id = ? AND attempts = ?", job.ID, job.Attempts,
+	).Updates(updates).Error
+}
@@ -0,0 +1,117 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/models/modelstest"
+)
+
+func enqueue(t *testing.T, queue *Queue, job models.Job) models.Job {
+	job.InstanceID = "instance"
+	job.Event = "pull_request"
+	job.Payload = "{}"
+	job, err := queue.Enqueue(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func assertSuperseded(t *testing.T, queue *Queue, job models.Job, expected bool) {
+	superseded, err := queue.Superseded(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if superseded != expected {
+		t.Errorf("Expected job %+v superseded %t, got %t", job, expected, superseded)
+	}
+}
+
+func TestSupersededByNewerCommit(t *testing.T) {
+	db, close := modelstest.Connect(t)
+	defer close()
+	queue := NewQueue(db, time.Minute)
+
+	first := enqueue(t, queue, models.Job{Number: 1, Sha: "aaaaaaa"})
+	same := enqueue(t, queue, models.Job{Number: 1, Sha: "aaaaaaa"})
+	other := enqueue(t, queue, models.Job{Number: 2, Sha: "bbbbbbb"})
+	assertSuperseded(t, queue, first, false)
+	assertSuperseded(t, queue, same, false)
+	assertSuperseded(t, queue, other, false)
+
+	enqueue(t, queue, models.Job{Number: 1, Sha: "ccccccc"})
+	assertSuperseded(t, queue, first, true)
+	assertSuperseded(t, queue, same, true)
+	assertSuperseded(t, queue, other, false)
+}
+
+func TestSupersededByNewerPush(t *testing.T) {
+	db, close := modelstest.Connect(t)
+	defer close()
+	queue := NewQueue(db, time.Minute)
+
+	first := enqueue(t, queue, models.Job{Branch: "feature/a", Sha: "aaaaaaa"})
+	enqueue(t, queue, models.Job{Branch: "feature/b", Sha: "bbbbbbb"})
+	assertSuperseded(t, queue, first, false)
+
+	enqueue(t, queue, models.Job{Branch: "feature/a", Sha: "ccccccc"})
+	assertSuperseded(t, queue, first, true)
+}
+
+func TestTeardownNotSuperseded(t *testing.T) {
+	db, close := modelstest.Connect(t)
+	defer close()
+	queue := NewQueue(db, time.Minute)
+
+	// An unlabeled teardown followed by a synchronize, which won't deploy
+	// since the label is gone
+	teardown := enqueue(t, queue, models.Job{Sha: "aaaaaaa"})
+	enqueue(t, queue, models.Job{Number: 1, Sha: "bbbbbbb"})
+	assertSuperseded(t, queue, teardown, false)
+}
+
+func TestClaimExpiredLease(t *testing.T) {
+	db, close := modelstest.Connect(t)
+	defer close()
+	queue := NewQueue(db, time.Minute)
+
+	job := enqueue(t, queue, models.Job{Number: 1, Sha: "aaaaaaa"})
+	claimed, ok, err := queue.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || claimed.ID != job.ID || claimed.Attempts != 1 {
+		t.Fatalf("Expected job %d to be claimed, got %+v", job.ID, claimed)
+	}
+
+	_, ok, err = queue.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("Expected a running job not to be claimed twice")
+	}
+
+	// A worker that stops renewing its lease loses the job
+	err = db.Exec("UPDATE jobs SET claimed_at = now() - interval '1 hour'").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	reclaimed, ok, err := queue.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || reclaimed.ID != job.ID || reclaimed.Attempts != 2 {
+		t.Fatalf("Expected job %d to be claimed again, got %+v", job.ID, reclaimed)
+	}
+
+	renewed, err := queue.Renew(claimed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed {
+		t.Error("Expected the first claim's lease to be lost")
+	}
+}
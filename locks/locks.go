@@ -0,0 +1,49 @@
+package locks
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+)
+
+// Locker serializes work on a Cloud Foundry space across every broker
+// instance sharing the database, using Postgres session advisory locks
+type Locker struct {
+	db *sql.DB
+}
+
+func NewLocker(db *sql.DB) *Locker {
+	return &Locker{db: db}
+}
+
+// Lock blocks until the lock for the space is held. Waiting callers acquire
+// the lock in the order they requested it. The returned function releases
+// the lock. Lock gives up waiting if ctx is cancelled.
+func (l *Locker) Lock(ctx context.Context, orgID, space string) (func() error, error) {
+	// Advisory locks belong to a session, so lock and unlock must run on the
+	// same connection
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	orgKey, spaceKey := key(orgID), key(space)
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1, $2)", orgKey, spaceKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	unlock := func() error {
+		defer conn.Close()
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1, $2)", orgKey, spaceKey)
+		return err
+	}
+	return unlock, nil
+}
+
+func key(s string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return int32(h.Sum32())
+}
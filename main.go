@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/gorilla/mux"
@@ -12,6 +15,8 @@ import (
 	"github.com/jmcarp/cf-review-app/broker"
 	"github.com/jmcarp/cf-review-app/config"
 	"github.com/jmcarp/cf-review-app/handlers"
+	"github.com/jmcarp/cf-review-app/jobs"
+	"github.com/jmcarp/cf-review-app/locks"
 	"github.com/jmcarp/cf-review-app/models"
 	"github.com/jmcarp/cf-review-app/webhooks"
 )
@@ -25,16 +30,55 @@ func main() {
 		logger.Fatal("settings", err)
 	}
 
+	keys, err := settings.EncryptionKeyMap()
+	if err != nil {
+		logger.Fatal("settings", err)
+	}
+	keyring, err := models.NewKeyring(settings.EncryptionKeyID, keys)
+	if err != nil {
+		logger.Fatal("settings", err)
+	}
+	models.SetKeyring(keyring)
+
 	db, err := config.Connect(settings.DatabaseURL)
 	if err != nil {
 		logger.Fatal("connect", err)
 	}
 
-	err = db.AutoMigrate(&models.Hook{}).Error
+	err = db.AutoMigrate(
+		&models.Hook{},
+		&models.Job{},
+		&models.ReviewApp{},
+		&models.Deployment{},
+		&models.Approval{},
+		&models.Delivery{},
+	).Error
 	if err != nil {
 		logger.Fatal("migrate", err)
 	}
 
+	// Encrypted values don't fit the columns of plaintext ones
+	err = db.Exec(`
+		ALTER TABLE hooks
+		ALTER COLUMN token TYPE text,
+		ALTER COLUMN secret TYPE text,
+		ALTER COLUMN previous_secret TYPE text
+	`).Error
+	if err != nil {
+		logger.Fatal("migrate", err)
+	}
+
+	// `cf-review-app reencrypt` encrypts every hook under the current key,
+	// e.g. after the key is changed, instead of waiting for hooks to be used
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		count, err := models.ReencryptHooks(db)
+		if err != nil {
+			logger.Fatal("reencrypt", err)
+		}
+		logger.Info("reencrypt", lager.Data{"hooks": count})
+		return
+	}
+
 	credentials := brokerapi.BrokerCredentials{
 		Username: settings.BrokerUsername,
 		Password: settings.BrokerPassword,
@@ -42,15 +86,67 @@ func main() {
 
 	// Attach webhook routes
 	router := mux.NewRouter()
-	handler := handlers.NewHookHandler(db, settings)
+	queue := jobs.NewQueue(db, settings.JobLease)
+	locker := locks.NewLocker(db.DB())
+	handler := handlers.NewHookHandler(db, queue, locker, settings)
 	router.HandleFunc("/hook/{instance}", handler.Handle).Methods("POST")
 	http.Handle("/hook/", router)
 
-	// Attach service broker routes
+	// Attach instance and review app status routes
 	manager := webhooks.NewManager(db, settings, webhooks.NewClient)
+	instances := handlers.NewInstanceHandler(db, manager)
+	router.HandleFunc("/instances/{instance}", instances.Get).Methods("GET")
+	router.HandleFunc("/instances/{instance}/rotate-secret", instances.RotateSecret).Methods("POST")
+	apps := handlers.NewAppHandler(db)
+	router.HandleFunc("/instances/{instance}/apps", apps.List).Methods("GET")
+	router.HandleFunc("/instances/{instance}/apps/{pr}", apps.Get).Methods("GET")
+	http.Handle("/instances/", handlers.BasicAuth(
+		settings.BrokerUsername, settings.BrokerPassword, router,
+	))
+
+	// Attach deployment log routes
+	logs := handlers.NewLogHandler(db)
+	router.HandleFunc("/deployments/{id}/log", logs.Get).Methods("GET")
+	http.Handle("/deployments/", router)
+
+	// Process webhook deliveries in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := jobs.NewPool(queue, handler.Process, settings.Workers, settings.JobPollInterval, logger)
+	drained := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(drained)
+	}()
+	go handler.PruneDeliveries(ctx, logger)
+	go webhooks.RotateSecrets(ctx, manager, settings.SecretCheckInterval, logger)
+	go func() {
+		err := manager.UpdateEvents()
+		if err != nil {
+			logger.Error("update-webhook-events", err)
+		}
+	}()
+
+	// Attach service broker routes
 	broker := broker.New(manager)
 	brokerAPI := brokerapi.New(&broker, logger, credentials)
 	http.Handle("/", brokerAPI)
 
-	http.ListenAndServe(fmt.Sprintf(":%s", settings.Port), nil)
+	server := &http.Server{Addr: fmt.Sprintf(":%s", settings.Port)}
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			logger.Fatal("serve", err)
+		}
+	}()
+
+	// On shutdown, stop accepting deliveries and claiming jobs, and let
+	// running jobs finish. Jobs cut short are claimed again once their lease
+	// expires.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	logger.Info("shutdown")
+	server.Shutdown(context.Background())
+	cancel()
+	<-drained
 }
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix marks encrypted values, so that values written before
+// encryption was introduced can be told apart and migrated
+const encryptedPrefix = "enc:v1:"
+
+var errNoKeyring = errors.New("No encryption keys configured")
+
+// Keyring holds the key-encryption keys, by ID. New values are encrypted
+// under the current key; the others are kept to decrypt older values.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring creates a keyring of 32-byte AES-256 keys
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("Invalid encryption key ID %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Encryption key %s must be 32 bytes", id)
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("Unknown encryption key %s", current)
+	}
+	return &Keyring{current: current, keys: keys}, nil
+}
+
+var keyring *Keyring
+
+// SetKeyring sets the keys used to encrypt and decrypt Encrypted values
+func SetKeyring(k *Keyring) {
+	keyring = k
+}
+
+// CurrentKeyID returns the ID of the key new values are encrypted under
+func CurrentKeyID() string {
+	if keyring == nil {
+		return ""
+	}
+	return keyring.current
+}
+
+// seal encrypts plaintext with a new data key, and the data key with the
+// current key-encryption key. The result names the key-encryption key.
+func (k *Keyring) seal(plaintext []byte) (string, error) {
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := gcmSeal(k.keys[k.current], dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := gcmSeal(dataKey, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + strings.Join([]string{
+		k.current,
+		base64.StdEncoding.EncodeToString(wrapped),
+		base64.StdEncoding.EncodeToString(ciphertext),
+	}, ":"), nil
+}
+
+func (k *Keyring) open(value string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed encrypted value")
+	}
+
+	key, ok := k.keys[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("Unknown encryption key %s", parts[0])
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := gcmOpen(key, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dataKey, ciphertext)
+}
+
+// gcmSeal encrypts plaintext with AES-GCM, prefixing the result with its
+// nonce
+func gcmSeal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func gcmOpen(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("Malformed encrypted value")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// Encrypted is a string that is stored encrypted. Empty strings are stored
+// as they are, so that they can still be queried.
+type Encrypted string
+
+func (e Encrypted) Value() (driver.Value, error) {
+	if e == "" {
+		return "", nil
+	}
+	if keyring == nil {
+		return nil, errNoKeyring
+	}
+	return keyring.seal([]byte(e))
+}
+
+// Scan decrypts a stored value. Values stored before encryption was
+// introduced are read as they are.
+func (e *Encrypted) Scan(src interface{}) error {
+	var value string
+	switch src := src.(type) {
+	case nil:
+		value = ""
+	case string:
+		value = src
+	case []byte:
+		value = string(src)
+	default:
+		return fmt.Errorf("Cannot scan %T into Encrypted", src)
+	}
+
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		*e = Encrypted(value)
+		return nil
+	}
+	if keyring == nil {
+		return errNoKeyring
+	}
+
+	plaintext, err := keyring.open(value)
+	if err != nil {
+		return err
+	}
+	*e = Encrypted(plaintext)
+	return nil
+}
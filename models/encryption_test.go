@@ -0,0 +1,193 @@
+package models
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, current string, ids ...string) *Keyring {
+	keys := map[string][]byte{}
+	for i, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte('a' + i)}, 32)
+	}
+	k, err := NewKeyring(current, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestNewKeyring(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	tests := []struct {
+		name    string
+		current string
+		keys    map[string][]byte
+		valid   bool
+	}{
+		{"valid", "k1", map[string][]byte{"k1": key}, true},
+		{"old key", "k2", map[string][]byte{"k1": key, "k2": key}, true},
+		{"unknown current key", "k2", map[string][]byte{"k1": key}, false},
+		{"short key", "k1", map[string][]byte{"k1": key[:16]}, false},
+		{"empty ID", "", map[string][]byte{"": key}, false},
+		{"ID with colon", "k:1", map[string][]byte{"k:1": key}, false},
+	}
+
+	for _, test := range tests {
+		_, err := NewKeyring(test.current, test.keys)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	k := testKeyring(t, "k1", "k1")
+
+	sealed, err := k.seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, encryptedPrefix+"k1:") {
+		t.Errorf("Sealed value doesn't name its key: %s", sealed)
+	}
+	if strings.Contains(sealed, "secret") {
+		t.Error("Sealed value contains the plaintext")
+	}
+
+	again, err := k.seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == sealed {
+		t.Error("Sealing the same value twice gave the same result")
+	}
+
+	opened, err := k.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != "secret" {
+		t.Errorf("Expected secret, got %s", opened)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	old := testKeyring(t, "k1", "k1")
+	sealed, err := old.seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(sealed, encryptedPrefix), ":")
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"malformed", encryptedPrefix + "k1:abc"},
+		{"unknown key", encryptedPrefix + strings.Join([]string{"k9", parts[1], parts[2]}, ":")},
+		{"bad base64", encryptedPrefix + strings.Join([]string{"k1", "!!!", parts[2]}, ":")},
+		{"swapped parts", encryptedPrefix + strings.Join([]string{"k1", parts[2], parts[1]}, ":")},
+		{"truncated", encryptedPrefix + strings.Join([]string{"k1", parts[1], "AAAA"}, ":")},
+	}
+
+	for _, test := range tests {
+		_, err := old.open(test.value)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	// A keyring that doesn't hold the key can't open the value
+	other := testKeyring(t, "k2", "k2")
+	_, err = other.open(sealed)
+	if err == nil {
+		t.Error("Expected an error for a missing key")
+	}
+}
+
+func TestEncryptedRotatedKey(t *testing.T) {
+	defer SetKeyring(keyring)
+
+	SetKeyring(testKeyring(t, "k1", "k1"))
+	value, err := Encrypted("secret").Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values encrypted under an old key are still read after the current
+	// key changes
+	SetKeyring(testKeyring(t, "k2", "k1", "k2"))
+	var e Encrypted
+	err = e.Scan(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e != "secret" {
+		t.Errorf("Expected secret, got %s", e)
+	}
+}
+
+func TestEncryptedScan(t *testing.T) {
+	defer SetKeyring(keyring)
+	SetKeyring(testKeyring(t, "k1", "k1"))
+
+	sealed, err := Encrypted("secret").Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		src      interface{}
+		expected Encrypted
+		valid    bool
+	}{
+		{"encrypted", sealed, "secret", true},
+		{"encrypted bytes", []byte(sealed.(string)), "secret", true},
+		{"legacy plaintext", "plain-token", "plain-token", true},
+		{"legacy plaintext bytes", []byte("plain-token"), "plain-token", true},
+		{"null", nil, "", true},
+		{"corrupt", encryptedPrefix + "k1:abc", "", false},
+		{"wrong type", 42, "", false},
+	}
+
+	for _, test := range tests {
+		var e Encrypted
+		err := e.Scan(test.src)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", test.name, test.valid, err)
+			continue
+		}
+		if test.valid && e != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, e)
+		}
+	}
+}
+
+func TestEncryptedWithoutKeyring(t *testing.T) {
+	defer SetKeyring(keyring)
+	SetKeyring(testKeyring(t, "k1", "k1"))
+	sealed, err := Encrypted("secret").Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetKeyring(nil)
+	_, err = Encrypted("secret").Value()
+	if err != errNoKeyring {
+		t.Errorf("Expected %v, got %v", errNoKeyring, err)
+	}
+	var e Encrypted
+	err = e.Scan(sealed)
+	if err != errNoKeyring {
+		t.Errorf("Expected %v, got %v", errNoKeyring, err)
+	}
+
+	// Empty values are stored as they are
+	value, err := Encrypted("").Value()
+	if err != nil || value != "" {
+		t.Errorf("Expected an empty value, got %v, %v", value, err)
+	}
+}
@@ -1,14 +1,149 @@
 package models
 
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Hook is the GitHub webhook of a service instance. Its token and secrets
+// are encrypted under the key named by KeyID.
 type Hook struct {
-	ID         uint   `gorm:"primary_key"`
-	Token      string `gorm:"not null"`
-	Secret     string `gorm:"not null"`
+	ID         uint      `gorm:"primary_key"`
+	Token      Encrypted `gorm:"type:text;not null"`
+	Secret     Encrypted `gorm:"type:text;not null"`
+	KeyID      string
 	InstanceID string `gorm:"not null;unique_index"`
 	OrgID      string `gorm:"not null;unique_index:idx_org_owner_repo"`
 	Owner      string `gorm:"not null;unique_index:idx_org_owner_repo"`
 	Repo       string `gorm:"not null;unique_index:idx_org_owner_repo"`
 	HookID     int64
+	// InstallationID, if set, authenticates the hook as that installation of
+	// the GitHub App instead of with Token
+	InstallationID int64
+	// Environment prefixes the GitHub environment of each pull request
+	Environment string `gorm:"not null;default:'review'"`
+	// ForkDeploys allows pull requests from forks to be deployed once a
+	// maintainer applies ForkLabel
+	ForkDeploys bool `gorm:"not null;default:false"`
+	ForkLabel   string
+	// DeployLabel, if set, limits review apps to pull requests carrying it
+	DeployLabel string
+	// Branches lists comma-separated glob patterns of branches deployed on
+	// every push
+	Branches string
+	// RequireSHA256 rejects deliveries signed only with HMAC-SHA1
+	RequireSHA256     bool `gorm:"column:require_sha256;not null;default:false"`
+	SignatureFailures int  `gorm:"not null;default:0"`
+	// PreviousSecret is still accepted for a grace period after the secret
+	// is rotated, until GitHub has switched to the new secret
+	PreviousSecret  Encrypted `gorm:"type:text"`
+	SecretRotatedAt *time.Time
+}
+
+// BeforeSave records the key that the hook's values are encrypted under
+func (h *Hook) BeforeSave() error {
+	h.KeyID = CurrentKeyID()
+	return nil
+}
+
+// AfterFind re-encrypts a hook that is stored in plaintext or under an old
+// key, so that hooks are migrated as they are used
+func (h *Hook) AfterFind(scope *gorm.Scope) error {
+	current := CurrentKeyID()
+	if h.KeyID == current {
+		return nil
+	}
+
+	// The values may have been replaced since they were read, e.g. by a
+	// secret rotation, which encrypts them under the current key itself
+	result := scope.NewDB().Model(&Hook{}).Where(
+		"id = ? AND COALESCE(key_id, '') = ?", h.ID, h.KeyID,
+	).UpdateColumns(EncryptedColumns(*h))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		h.KeyID = current
+	}
+	return nil
+}
+
+// EncryptedColumns returns the encrypted columns of hook, for updates that
+// bypass BeforeSave. Every value is encrypted again under the current key.
+func EncryptedColumns(hook Hook) map[string]interface{} {
+	return map[string]interface{}{
+		"token":           hook.Token,
+		"secret":          hook.Secret,
+		"previous_secret": hook.PreviousSecret,
+		"key_id":          CurrentKeyID(),
+	}
+}
+
+// ReencryptHooks encrypts every hook that isn't yet encrypted under the
+// current key. Loading the hooks migrates them; see AfterFind.
+func ReencryptHooks(db *gorm.DB) (int, error) {
+	hooks := []Hook{}
+	err := db.Where(
+		"key_id IS NULL OR key_id != ?", CurrentKeyID(),
+	).Find(&hooks).Error
+	return len(hooks), err
+}
+
+// AcceptsPreviousSecret reports whether deliveries signed with the previous
+// secret are still accepted at now
+func (h Hook) AcceptsPreviousSecret(now time.Time, grace time.Duration) bool {
+	return h.PreviousSecret != "" && h.SecretRotatedAt != nil &&
+		now.Before(h.SecretRotatedAt.Add(grace))
+}
+
+const (
+	JobPending    = "pending"
+	JobRunning    = "running"
+	JobSucceeded  = "succeeded"
+	JobFailed     = "failed"
+	JobSuperseded = "superseded"
+)
+
+// ErrSuperseded is the result of a job that was dropped because a newer
+// commit was pushed to the same pull request
+var ErrSuperseded = errors.New("Superseded by a newer commit")
+
+// Job is a webhook delivery queued for processing by the worker pool
+type Job struct {
+	ID         uint   `gorm:"primary_key"`
+	InstanceID string `gorm:"not null;index"`
+	Event      string `gorm:"not null"`
+	Number     int    `gorm:"index"`
+	Branch     string
+	Sha        string
+	Payload    string `gorm:"type:text;not null"`
+	State      string `gorm:"not null;index"`
+	Error      string `gorm:"type:text"`
+	Attempts   int    `gorm:"not null;default:0"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	StartedAt  *time.Time
+	// ClaimedAt is renewed while the job runs; a running job that isn't
+	// renewed for the queue's lease is claimed again
+	ClaimedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+// Delivery records a webhook delivery and the response it was given, so
+// that a redelivery gets the same response. Status is zero while the
+// delivery is being handled, and UpdatedAt is when it was last claimed.
+type Delivery struct {
+	ID         uint   `gorm:"primary_key"`
+	InstanceID string `gorm:"not null;unique_index:idx_instance_guid"`
+	GUID       string `gorm:"not null;unique_index:idx_instance_guid"`
+	Event      string `gorm:"not null"`
+	Status     int    `gorm:"not null"`
+	Response   string `gorm:"type:text"`
+	JobID      *uint
+	CreatedAt  time.Time `gorm:"index"`
+	UpdatedAt  time.Time
 }
 
 type App struct {
@@ -24,3 +159,13 @@ type Service struct {
 	Tags    []string
 	Config  map[string]interface{}
 }
+
+// Approval allows one commit of a pull request from a fork to be deployed
+type Approval struct {
+	ID         uint   `gorm:"primary_key"`
+	InstanceID string `gorm:"not null;unique_index:idx_instance_number_sha"`
+	Number     int    `gorm:"not null;unique_index:idx_instance_number_sha"`
+	Sha        string `gorm:"not null;unique_index:idx_instance_number_sha"`
+	Approver   string `gorm:"not null"`
+	CreatedAt  time.Time
+}
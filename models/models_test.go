@@ -0,0 +1,33 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcceptsPreviousSecret(t *testing.T) {
+	now := time.Now()
+	rotated := now.Add(-30 * time.Minute)
+
+	tests := []struct {
+		name      string
+		previous  Encrypted
+		rotatedAt *time.Time
+		grace     time.Duration
+		expected  bool
+	}{
+		{"within grace period", "old", &rotated, time.Hour, true},
+		{"after grace period", "old", &rotated, 10 * time.Minute, false},
+		{"at end of grace period", "old", &rotated, 30 * time.Minute, false},
+		{"no grace period", "old", &rotated, 0, false},
+		{"no previous secret", "", &rotated, time.Hour, false},
+		{"never rotated", "old", nil, time.Hour, false},
+	}
+
+	for _, test := range tests {
+		hook := Hook{PreviousSecret: test.previous, SecretRotatedAt: test.rotatedAt}
+		if accepts := hook.AcceptsPreviousSecret(now, test.grace); accepts != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, accepts)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package modelstest connects tests to the Postgres database named by
+// TEST_DATABASE_URL, since the job queue, locks and delivery records rely on
+// Postgres features. Tests that need a database are skipped without one,
+// except in CI, where they fail.
+package modelstest
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/jmcarp/cf-review-app/config"
+	"github.com/jmcarp/cf-review-app/locks"
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+var tables = []interface{}{
+	&models.Hook{},
+	&models.Job{},
+	&models.ReviewApp{},
+	&models.Deployment{},
+	&models.Approval{},
+	&models.Delivery{},
+}
+
+// Connect empties the test database and returns a connection to it, and a
+// function that closes the connection. Packages are tested in parallel, so
+// each test holds a lock on the database until it closes the connection.
+func Connect(t *testing.T) (*gorm.DB, func()) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		// Skipping in CI would pass a build that tested nothing
+		if os.Getenv("CI") != "" {
+			t.Fatal("TEST_DATABASE_URL must be set in CI")
+		}
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	keyring, err := models.NewKeyring("test", map[string][]byte{
+		"test": bytes.Repeat([]byte("k"), 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	models.SetKeyring(keyring)
+
+	db, err := config.Connect(databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := locks.NewLocker(db.DB()).Lock(context.Background(), "cf-review-app", "tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	close := func() {
+		unlock()
+		db.Close()
+	}
+
+	for _, table := range tables {
+		err = db.DropTableIfExists(table).Error
+		if err != nil {
+			close()
+			t.Fatal(err)
+		}
+	}
+	err = db.CreateTable(tables...).Error
+	if err != nil {
+		close()
+		t.Fatal(err)
+	}
+
+	return db, close
+}
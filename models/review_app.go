@@ -0,0 +1,79 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	StatePending    = "pending"
+	StateDeploying  = "deploying"
+	StateDeployed   = "deployed"
+	StateFailed     = "failed"
+	StateDestroying = "destroying"
+	StateDestroyed  = "destroyed"
+)
+
+// transitions lists the states each review app state can move to. Deploying
+// and destroying can restart themselves, or each other, so that work
+// interrupted by a crash can be retried or replaced.
+var transitions = map[string][]string{
+	StatePending:    {StateDeploying, StateDestroying},
+	StateDeploying:  {StateDeploying, StateDeployed, StateFailed, StatePending, StateDestroying},
+	StateDeployed:   {StateDeploying, StateDestroying},
+	StateFailed:     {StateDeploying, StateDestroying},
+	StateDestroying: {StateDestroying, StateDestroyed, StateFailed, StateDeploying},
+	StateDestroyed:  {StatePending},
+}
+
+// ReviewApp is the environment of a pull request, or of a branch if Number
+// is zero
+type ReviewApp struct {
+	ID          uint   `gorm:"primary_key"`
+	InstanceID  string `gorm:"not null;unique_index:idx_instance_number_branch"`
+	Number      int    `gorm:"not null;unique_index:idx_instance_number_branch"`
+	Branch      string `gorm:"not null;default:'';unique_index:idx_instance_number_branch"`
+	Owner       string `gorm:"not null"`
+	Repo        string `gorm:"not null"`
+	Space       string `gorm:"not null"`
+	Sha         string
+	Route       string
+	State       string `gorm:"not null"`
+	Error       string `gorm:"type:text"`
+	CommentID   int64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeployedAt  *time.Time
+	DestroyedAt *time.Time
+}
+
+// Transition moves the app to state, or returns an error if the state
+// machine doesn't allow it
+func (a *ReviewApp) Transition(state string) error {
+	for _, allowed := range transitions[a.State] {
+		if allowed == state {
+			a.State = state
+			return nil
+		}
+	}
+	return fmt.Errorf("Review app %d cannot move from %s to %s", a.Number, a.State, state)
+}
+
+const DeploymentSuperseded = "superseded"
+
+// Deployment is one attempt to deploy a commit to a review app. Its state is
+// deploying, deployed, failed or superseded.
+type Deployment struct {
+	ID          uint   `gorm:"primary_key"`
+	ReviewAppID uint   `gorm:"not null;index"`
+	Sha         string `gorm:"not null"`
+	State       string `gorm:"not null"`
+	GitHubID    int64  `gorm:"column:github_id"`
+	Route       string
+	Error       string `gorm:"type:text"`
+	Log         string `gorm:"type:text"`
+	LogToken    string `gorm:"not null"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	FinishedAt  *time.Time
+}
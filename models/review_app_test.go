@@ -0,0 +1,53 @@
+package models
+
+import "testing"
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		allowed bool
+	}{
+		{StatePending, StateDeploying, true},
+		{StatePending, StateDestroying, true},
+		{StatePending, StateDeployed, false},
+		{StateDeploying, StateDeploying, true},
+		{StateDeploying, StateDeployed, true},
+		{StateDeploying, StateFailed, true},
+		{StateDeploying, StatePending, true},
+		{StateDeploying, StateDestroying, true},
+		{StateDeploying, StateDestroyed, false},
+		{StateDeployed, StateDeploying, true},
+		{StateDeployed, StateDestroying, true},
+		{StateDeployed, StateFailed, false},
+		{StateFailed, StateDeploying, true},
+		{StateFailed, StateDestroying, true},
+		{StateFailed, StateDeployed, false},
+		{StateDestroying, StateDestroying, true},
+		{StateDestroying, StateDestroyed, true},
+		{StateDestroying, StateFailed, true},
+		// A reopen or deploy command replaces an interrupted destroy
+		{StateDestroying, StateDeploying, true},
+		{StateDestroying, StateDeployed, false},
+		{StateDestroyed, StatePending, true},
+		{StateDestroyed, StateDeploying, false},
+		{StateDestroyed, StateDestroying, false},
+		{"", StateDeploying, false},
+	}
+
+	for _, test := range tests {
+		app := ReviewApp{State: test.from}
+		err := app.Transition(test.to)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s to %s: expected allowed %t, got error %v", test.from, test.to, test.allowed, err)
+		}
+
+		expected := test.from
+		if test.allowed {
+			expected = test.to
+		}
+		if app.State != expected {
+			t.Errorf("%s to %s: expected state %s, got %s", test.from, test.to, expected, app.State)
+		}
+	}
+}
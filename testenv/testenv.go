@@ -0,0 +1,110 @@
+// Package testenv sets up the fakes that tests deploy review apps with: a
+// test database, a fake GitHub serving the archive of owner/repo, and a fake
+// Cloud Foundry with an org to deploy to.
+package testenv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/jmcarp/cf-review-app/cloudfoundry/cftest"
+	"github.com/jmcarp/cf-review-app/config"
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/models/modelstest"
+	"github.com/jmcarp/cf-review-app/webhooks/githubtest"
+)
+
+const (
+	// Sha is the commit of owner/repo that GitHub serves Files for
+	Sha    = "0123456789abcdef0123456789abcdef01234567"
+	Secret = "secret"
+)
+
+// Files is a review app with a web app bound to a database
+var Files = map[string]string{
+	"app.yml": `
+name: web
+manifest: manifest.yml
+services:
+- name: db
+  service: postgres
+  plan: small
+`,
+	"manifest.yml": `
+applications:
+- name: web
+  buildpack: python_buildpack
+  services:
+  - db
+`,
+	"index.html": "hello",
+}
+
+// Env deploys review apps of owner/repo from a fake GitHub to a fake Cloud
+// Foundry
+type Env struct {
+	DB       *gorm.DB
+	GitHub   *githubtest.Server
+	CF       *cftest.Server
+	OrgGUID  string
+	Settings config.Settings
+	closeDB  func()
+}
+
+// New sets up an Env, skipping the test if there is no test database
+func New(t *testing.T) *Env {
+	db, closeDB := modelstest.Connect(t)
+
+	cf := cftest.NewServer()
+	orgGUID := cf.AddOrg("review")
+	cf.AddServicePlan("postgres", "small")
+
+	github := githubtest.NewServer()
+	err := github.SetArchive("owner", "repo", Sha, Files)
+	if err != nil {
+		github.Close()
+		cf.Close()
+		closeDB()
+		t.Fatal(err)
+	}
+
+	return &Env{
+		DB:      db,
+		GitHub:  github,
+		CF:      cf,
+		OrgGUID: orgGUID,
+		Settings: config.Settings{
+			CFURL:                cf.URL,
+			CFUsername:           cftest.Username,
+			CFPassword:           cftest.Password,
+			CFPollInterval:       time.Millisecond,
+			BaseURL:              "https://broker.example.com",
+			GitHubURL:            github.URL + "/",
+			JobLease:             time.Minute,
+			DeliveryClaimTimeout: time.Minute,
+			SecretGracePeriod:    time.Hour,
+		},
+		closeDB: closeDB,
+	}
+}
+
+func (e *Env) Close() {
+	e.GitHub.Close()
+	e.CF.Close()
+	e.closeDB()
+}
+
+// Hook returns an unsaved hook of owner/repo that deploys to the org
+func (e *Env) Hook() models.Hook {
+	return models.Hook{
+		InstanceID:  "instance",
+		OrgID:       e.OrgGUID,
+		Owner:       "owner",
+		Repo:        "repo",
+		Token:       "token",
+		Secret:      Secret,
+		Environment: "review",
+	}
+}
@@ -2,10 +2,13 @@ package utils
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func Untar(reader io.Reader, dest string) error {
@@ -48,3 +51,97 @@ func Untar(reader io.Reader, dest string) error {
 	}
 	return nil
 }
+
+// Zip writes the files under src to dest as a zip archive. Paths matching a
+// pattern in src/.cfignore are skipped, as `cf push` does.
+func Zip(src string, dest io.Writer) error {
+	ignored, err := readIgnore(filepath.Join(src, ".cfignore"))
+	if err != nil {
+		return err
+	}
+
+	zipWriter := zip.NewWriter(dest)
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if isIgnored(rel, ignored) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			header.Name += "/"
+			_, err = zipWriter.CreateHeader(header)
+			return err
+		}
+
+		header.Method = zip.Deflate
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(writer, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return zipWriter.Close()
+}
+
+func readIgnore(path string) ([]string, error) {
+	patterns := []string{".git", ".cfignore"}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return patterns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.Trim(line, "/"))
+	}
+	return patterns, nil
+}
+
+func isIgnored(rel string, patterns []string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, rel); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, filepath.Base(rel)); matched {
+			return true
+		}
+	}
+	return false
+}
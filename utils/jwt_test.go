@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func decodeJWTPart(t *testing.T, part string, value interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwt, err := SignJWT(key, map[string]interface{}{"iss": 42, "iat": 1500000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected three parts, got %d: %s", len(parts), jwt)
+	}
+
+	header := map[string]string{}
+	decodeJWTPart(t, parts[0], &header)
+	if header["alg"] != "RS256" || header["typ"] != "JWT" {
+		t.Errorf("Unexpected header %v", header)
+	}
+
+	claims := map[string]int{}
+	decodeJWTPart(t, parts[1], &claims)
+	if claims["iss"] != 42 || claims["iat"] != 1500000000 {
+		t.Errorf("Unexpected claims %v", claims)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		t.Errorf("Invalid signature: %s", err)
+	}
+
+	// The signature covers the claims
+	other := sha256.Sum256([]byte(parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":43}`))))
+	if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, other[:], signature) == nil {
+		t.Error("Expected the signature not to match other claims")
+	}
+}
+
+func TestSignJWTUnencodableClaims(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SignJWT(key, map[string]interface{}{"iss": func() {}})
+	if err == nil {
+		t.Error("Expected an error for claims that can't be encoded")
+	}
+}
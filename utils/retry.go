@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Backoff configures how transient failures are retried
+type Backoff struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+}
+
+var DefaultBackoff = Backoff{
+	Attempts: 5,
+	Initial:  500 * time.Millisecond,
+	Max:      30 * time.Second,
+}
+
+// Retry calls fn until it succeeds, fails with an error that transient
+// doesn't accept, runs out of attempts, or ctx is cancelled. The delay
+// between attempts doubles up to b.Max, with random jitter so that callers
+// failing together don't retry together.
+func Retry(ctx context.Context, b Backoff, transient func(error) bool, fn func() error) error {
+	delay := b.Initial
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= b.Attempts || !transient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		// Sleep for between half and all of the current delay
+		half := int64(delay / 2)
+		sleep := time.Duration(half + rand.Int63n(half+1))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+
+		delay *= 2
+		if delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
+
+// IsTransientStatus reports whether an HTTP status code indicates a failure
+// that may succeed if retried
+func IsTransientStatus(status int) bool {
+	switch status {
+	case 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// IsIdempotent reports whether a request with method can be repeated
+// without changing its effect. A POST that failed ambiguously, e.g. with a
+// server error, may have created something that repeating it duplicates.
+func IsIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// IsUnsent reports whether err is a failure to connect to a server, so that
+// the request never reached it
+func IsUnsent(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// IsNetworkError reports whether err is a failure to reach a server or read
+// its response, as opposed to an error response or a cancelled request
+func IsNetworkError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = errors.New("Transient")
+	errPermanent = errors.New("Permanent")
+)
+
+var testBackoff = Backoff{Attempts: 3, Initial: time.Millisecond, Max: 2 * time.Millisecond}
+
+func isTestTransient(err error) bool {
+	return err == errTransient
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		errs     []error
+		expected error
+		calls    int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"transient", []error{errTransient, errTransient, nil}, nil, 3},
+		{"out of attempts", []error{errTransient, errTransient, errTransient, nil}, errTransient, 3},
+		{"permanent", []error{errTransient, errPermanent, nil}, errPermanent, 2},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		err := Retry(context.Background(), testBackoff, isTestTransient, func() error {
+			err := test.errs[calls]
+			calls++
+			return err
+		})
+		if err != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+		if calls != test.calls {
+			t.Errorf("%s: expected %d calls, got %d", test.name, test.calls, calls)
+		}
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backoff := Backoff{Attempts: 5, Initial: time.Hour, Max: time.Hour}
+
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- Retry(ctx, backoff, isTestTransient, func() error {
+			calls++
+			return errTransient
+		})
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != errTransient || calls != 1 {
+			t.Errorf("Expected one failed call, got %d and %v", calls, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Retry didn't stop when its context was cancelled")
+	}
+}
+
+func TestIsIdempotent(t *testing.T) {
+	for _, method := range []string{"GET", "HEAD", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		if !IsIdempotent(method) {
+			t.Errorf("Expected %s to be idempotent", method)
+		}
+	}
+	for _, method := range []string{"POST", "CONNECT", "get", ""} {
+		if IsIdempotent(method) {
+			t.Errorf("Expected %s not to be idempotent", method)
+		}
+	}
+}
+
+func TestIsUnsent(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"dial", dial, true},
+		{"wrapped dial", &url.Error{Op: "Post", URL: "https://example.com", Err: dial}, true},
+		{"read", read, false},
+		{"wrapped read", &url.Error{Op: "Post", URL: "https://example.com", Err: read}, false},
+		{"unexpected EOF", &url.Error{Op: "Post", URL: "https://example.com", Err: io.ErrUnexpectedEOF}, false},
+		{"other", errPermanent, false},
+		{"nil", nil, false},
+	}
+
+	for _, test := range tests {
+		if unsent := IsUnsent(test.err); unsent != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, unsent)
+		}
+	}
+}
+
+func TestIsUnsentRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Skip("Closed port accepted a connection")
+	}
+	if !IsUnsent(err) {
+		t.Errorf("Expected %v to be unsent", err)
+	}
+}
@@ -3,15 +3,58 @@ package utils
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
-	"fmt"
+	"errors"
+	"hash"
+	"strings"
 )
 
-func CheckSignature(key, message []byte, signature string) bool {
-	h := hmac.New(sha1.New, key)
+var (
+	ErrMissingSignature   = errors.New("Missing signature")
+	ErrMalformedSignature = errors.New("Malformed signature")
+	ErrInvalidSignature   = errors.New("Invalid signature")
+	ErrSHA256Required     = errors.New("SHA-256 signature required")
+)
+
+// CheckSignature verifies the signatures of a webhook delivery, sent in the
+// X-Hub-Signature (HMAC-SHA1) and X-Hub-Signature-256 (HMAC-SHA256) headers.
+// The SHA-256 signature is checked if it is present. Otherwise the SHA-1
+// signature is, unless requireSHA256 is set.
+func CheckSignature(key, message []byte, sha1Signature, sha256Signature string, requireSHA256 bool) error {
+	if sha256Signature != "" {
+		return checkHMAC(sha256.New, "sha256=", key, message, sha256Signature)
+	}
+	if requireSHA256 {
+		if sha1Signature != "" {
+			return ErrSHA256Required
+		}
+		return ErrMissingSignature
+	}
+	if sha1Signature == "" {
+		return ErrMissingSignature
+	}
+	return checkHMAC(sha1.New, "sha1=", key, message, sha1Signature)
+}
+
+func checkHMAC(algorithm func() hash.Hash, prefix string, key, message []byte, signature string) error {
+	if !strings.HasPrefix(signature, prefix) {
+		return ErrMalformedSignature
+	}
+	digest, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return ErrMalformedSignature
+	}
+
+	h := hmac.New(algorithm, key)
 	h.Write(message)
-	digest := hex.EncodeToString(h.Sum(nil))
-	calculated := fmt.Sprintf("sha1=%s", digest)
-	return subtle.ConstantTimeCompare([]byte(signature), []byte(calculated)) == 1
+	expected := h.Sum(nil)
+	if len(digest) != len(expected) {
+		return ErrMalformedSignature
+	}
+	if subtle.ConstantTimeCompare(digest, expected) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
 }
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"testing"
+)
+
+func sign(algorithm func() hash.Hash, prefix, key, message string) string {
+	h := hmac.New(algorithm, []byte(key))
+	h.Write([]byte(message))
+	return prefix + hex.EncodeToString(h.Sum(nil))
+}
+
+func TestCheckSignature(t *testing.T) {
+	const key, message = "secret", `{"action": "opened"}`
+	sha1Signature := sign(sha1.New, "sha1=", key, message)
+	sha256Signature := sign(sha256.New, "sha256=", key, message)
+
+	tests := []struct {
+		name          string
+		sha1          string
+		sha256        string
+		requireSHA256 bool
+		expected      error
+	}{
+		{"sha256", "", sha256Signature, false, nil},
+		{"both", sha1Signature, sha256Signature, false, nil},
+		{"sha256 required", "", sha256Signature, true, nil},
+		{"sha1 fallback", sha1Signature, "", false, nil},
+		{"sha1 when sha256 required", sha1Signature, "", true, ErrSHA256Required},
+		{"missing", "", "", false, ErrMissingSignature},
+		{"missing when sha256 required", "", "", true, ErrMissingSignature},
+		{"wrong key", "", sign(sha256.New, "sha256=", "other", message), false, ErrInvalidSignature},
+		{"wrong message", "", sign(sha256.New, "sha256=", key, "{}"), false, ErrInvalidSignature},
+		{"wrong sha1", sign(sha1.New, "sha1=", "other", message), "", false, ErrInvalidSignature},
+		// The SHA-256 signature is checked when it is sent, even if the
+		// SHA-1 signature is valid
+		{"valid sha1, wrong sha256", sha1Signature, sign(sha256.New, "sha256=", "other", message), false, ErrInvalidSignature},
+		{"sha1 in sha256 header", "", sign(sha1.New, "sha256=", key, message), false, ErrMalformedSignature},
+		{"sha256 in sha1 header", sign(sha256.New, "sha1=", key, message), "", false, ErrMalformedSignature},
+		{"wrong prefix", "", sign(sha256.New, "sha1=", key, message), false, ErrMalformedSignature},
+		{"no prefix", "", sign(sha256.New, "", key, message), false, ErrMalformedSignature},
+		{"not hex", "", "sha256=not-hex", false, ErrMalformedSignature},
+		{"truncated", "", sha256Signature[:len(sha256Signature)-2], false, ErrMalformedSignature},
+	}
+
+	for _, test := range tests {
+		err := CheckSignature([]byte(key), []byte(message), test.sha1, test.sha256, test.requireSHA256)
+		if err != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
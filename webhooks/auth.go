@@ -0,0 +1,110 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+
+	"github.com/jmcarp/cf-review-app/config"
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/utils"
+)
+
+// installationTokenMargin is how long before it expires an installation
+// token is replaced, so that it doesn't expire during a deploy's requests
+const installationTokenMargin = 5 * time.Minute
+
+// installationTokenTimeout bounds the exchange of a JWT for an installation
+// token, retries included. Token sources aren't passed a context, so
+// without it a hung request would block every job of the installation.
+const installationTokenTimeout = time.Minute
+
+var errNoGitHubApp = errors.New("GitHub App is not configured")
+
+// installations caches a token source per installation, so that
+// installation tokens are shared by every hook and job
+var installations = struct {
+	sync.Mutex
+	sources map[int64]oauth2.TokenSource
+}{sources: map[int64]oauth2.TokenSource{}}
+
+// Auth returns the credentials that hook uses with the GitHub API: tokens
+// of its GitHub App installation if it has one, and its personal access
+// token otherwise
+func Auth(hook models.Hook, settings config.Settings) oauth2.TokenSource {
+	if hook.InstallationID == 0 {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: string(hook.Token)})
+	}
+
+	installations.Lock()
+	defer installations.Unlock()
+
+	source, ok := installations.sources[hook.InstallationID]
+	if !ok {
+		source = oauth2.ReuseTokenSource(nil, &installationTokenSource{
+			installationID: hook.InstallationID,
+			settings:       settings,
+		})
+		installations.sources[hook.InstallationID] = source
+	}
+	return source
+}
+
+// installationTokenSource mints installation tokens, authenticating as the
+// GitHub App with a JWT signed by its private key
+type installationTokenSource struct {
+	installationID int64
+	settings       config.Settings
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	if s.settings.GitHubAppID == 0 {
+		return nil, errNoGitHubApp
+	}
+	key, err := s.settings.GitHubAppKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// GitHub rejects JWTs that expire more than ten minutes after they are
+	// issued; issuing them a minute early allows for clock drift
+	now := time.Now()
+	jwt, err := utils.SignJWT(key, map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": s.settings.GitHubAppID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := NewGitHubClient(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: jwt}), s.settings)
+
+	// go-github posts to the retired installations/{id}/access_tokens path
+	req, err := client.NewRequest(
+		"POST", fmt.Sprintf("app/installations/%d/access_tokens", s.installationID), nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), installationTokenTimeout)
+	defer cancel()
+	token := &github.InstallationToken{}
+	err = retry(ctx, func() error {
+		_, err := client.Do(ctx, req, token)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		Expiry:      token.GetExpiresAt().Add(-installationTokenMargin),
+	}, nil
+}
@@ -0,0 +1,149 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// https://developer.github.com/v3/activity/events/types/#pushevent
+type PushPayload struct {
+	Ref        string
+	After      string
+	Deleted    bool
+	Repository struct {
+		Name string
+		// Push payloads name the owner rather than giving its login
+		Owner struct {
+			Login string
+			Name  string
+		}
+	}
+	Sender UserPayload
+}
+
+func (p PushPayload) Owner() string {
+	if p.Repository.Owner.Login != "" {
+		return p.Repository.Owner.Login
+	}
+	return p.Repository.Owner.Name
+}
+
+func (p PushPayload) Repo() string {
+	return p.Repository.Name
+}
+
+// Branch returns the branch pushed to. The boolean result is false if a tag
+// was pushed.
+func (p PushPayload) Branch() (string, bool) {
+	if !strings.HasPrefix(p.Ref, "refs/heads/") {
+		return "", false
+	}
+	return strings.TrimPrefix(p.Ref, "refs/heads/"), true
+}
+
+// BranchPatterns splits a comma-separated list of branch glob patterns
+func BranchPatterns(patterns string) []string {
+	result := []string{}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			result = append(result, pattern)
+		}
+	}
+	return result
+}
+
+// MatchesBranch reports whether branch matches one of the glob patterns in
+// hook.Branches. As in paths, `*` doesn't match a slash.
+func MatchesBranch(hook models.Hook, branch string) bool {
+	for _, pattern := range BranchPatterns(hook.Branches) {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Push deploys the branch pushed to if it matches the patterns of hook, or
+// tears its review app down if the branch was deleted
+func (ph *PullHandler) Push(ctx context.Context, hook models.Hook, payload PushPayload) error {
+	branch, ok := payload.Branch()
+	if !ok || !MatchesBranch(hook, branch) {
+		return nil
+	}
+
+	t := target{
+		owner:  payload.Owner(),
+		repo:   payload.Repo(),
+		sha:    payload.After,
+		branch: branch,
+	}
+	if payload.Deleted {
+		return ph.close(ctx, hook, t)
+	}
+	return ph.open(ctx, hook, t)
+}
+
+// target is a commit to deploy to a review app: the head of a pull request,
+// or of a branch if number is zero
+type target struct {
+	owner  string
+	repo   string
+	sha    string
+	number int
+	branch string
+}
+
+func pullTarget(payload PullPayload) target {
+	return target{
+		owner:  payload.Owner(),
+		repo:   payload.Repo(),
+		sha:    payload.PullRequest.Head.Sha,
+		number: payload.Number,
+	}
+}
+
+// space names the Cloud Foundry space of the review app. Branch spaces end
+// in a hash of the branch, since several branches can share a slug.
+func (t target) space() string {
+	if t.branch != "" {
+		sum := sha256.Sum256([]byte(t.branch))
+		return fmt.Sprintf(
+			"%s-%s-branch-%s-%s",
+			t.owner, t.repo, slugify(t.branch), hex.EncodeToString(sum[:])[:7],
+		)
+	}
+	return getSpace(t.owner, t.repo, t.number)
+}
+
+// reviewApp returns the fields that identify the review app of t
+func (t target) reviewApp(hook models.Hook) models.ReviewApp {
+	return models.ReviewApp{
+		InstanceID: hook.InstanceID,
+		Number:     t.number,
+		Branch:     t.branch,
+	}
+}
+
+var slugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// maxSlugLength keeps branch space names within Cloud Foundry's limit of
+// 255 characters: GitHub owners and repos are at most 39 and 100
+// characters, and the rest of the name takes 17
+const maxSlugLength = 99
+
+// slugify reduces a branch name to lowercase letters, digits and dashes, at
+// most maxSlugLength of them
+func slugify(branch string) string {
+	slug := strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(branch), "-"), "-")
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	return slug
+}
@@ -0,0 +1,99 @@
+package webhooks
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+func TestSlugify(t *testing.T) {
+	long := strings.Repeat("a", maxSlugLength-1) + "/b"
+	tests := []struct {
+		branch   string
+		expected string
+	}{
+		{"main", "main"},
+		{"feature/login", "feature-login"},
+		{"Feature/Login", "feature-login"},
+		{"fix__double--dash", "fix-double-dash"},
+		{"/leading/and/trailing/", "leading-and-trailing"},
+		{"émoji-✨-branch", "moji-branch"},
+		{"v1.2.3", "v1-2-3"},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxSlugLength)},
+		// A dash left at the cut is trimmed
+		{long, strings.Repeat("a", maxSlugLength-1)},
+	}
+
+	for _, test := range tests {
+		if slug := slugify(test.branch); slug != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.branch, test.expected, slug)
+		}
+	}
+}
+
+func TestSpace(t *testing.T) {
+	pull := target{owner: "owner", repo: "repo", number: 1}
+	if space := pull.space(); space != "owner-repo-pull-1" {
+		t.Errorf("Expected owner-repo-pull-1, got %s", space)
+	}
+
+	branch := target{owner: "owner", repo: "repo", branch: "feature/login"}
+	space := branch.space()
+	if !strings.HasPrefix(space, "owner-repo-branch-feature-login-") || len(space) != len("owner-repo-branch-feature-login-")+7 {
+		t.Errorf("Unexpected space %s", space)
+	}
+	if again := branch.space(); again != space {
+		t.Errorf("Expected the same space for the same branch, got %s and %s", space, again)
+	}
+
+	// Branches that share a slug get their own spaces
+	names := map[string]string{}
+	for _, name := range []string{
+		"feature/login", "feature-login", "Feature/Login", "feature_login",
+		strings.Repeat("a", 300), strings.Repeat("a", 301),
+	} {
+		space := target{owner: "owner", repo: "repo", branch: name}.space()
+		if other, ok := names[space]; ok {
+			t.Errorf("Branches %s and %s share space %s", other, name, space)
+		}
+		names[space] = name
+	}
+
+	// The longest owner, repo and branch names fit Cloud Foundry's limit
+	longest := target{
+		owner:  strings.Repeat("o", 39),
+		repo:   strings.Repeat("r", 100),
+		branch: strings.Repeat("b", 250),
+	}
+	if space := longest.space(); len(space) > 255 {
+		t.Errorf("Expected at most 255 characters, got %d", len(space))
+	}
+}
+
+func TestMatchesBranch(t *testing.T) {
+	tests := []struct {
+		patterns string
+		branch   string
+		expected bool
+	}{
+		{"main", "main", true},
+		{"main", "maintenance", false},
+		{"feature/*", "feature/login", true},
+		{"feature/*", "feature/login/form", false},
+		{"feature/*", "feature", false},
+		{"feature/*/*", "feature/login/form", true},
+		{"release-*", "release-1.2", true},
+		{"main, feature/*", "feature/login", true},
+		{" main ,", "main", true},
+		{"", "main", false},
+		{"[", "[", false},
+	}
+
+	for _, test := range tests {
+		matched := MatchesBranch(models.Hook{Branches: test.patterns}, test.branch)
+		if matched != test.expected {
+			t.Errorf("%q, %s: expected %t, got %t", test.patterns, test.branch, test.expected, matched)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+const (
+	checkName     = "review-app"
+	checksPreview = "application/vnd.github.antiope-preview+json"
+)
+
+type checkRun struct {
+	ID          int64        `json:"id,omitempty"`
+	Name        string       `json:"name,omitempty"`
+	HeadSha     string       `json:"head_sha,omitempty"`
+	Status      string       `json:"status,omitempty"`
+	Conclusion  string       `json:"conclusion,omitempty"`
+	DetailsURL  string       `json:"details_url,omitempty"`
+	StartedAt   *time.Time   `json:"started_at,omitempty"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+	Output      *checkOutput `json:"output,omitempty"`
+}
+
+type checkOutput struct {
+	Title       string            `json:"title"`
+	Summary     string            `json:"summary"`
+	Text        string            `json:"text,omitempty"`
+	Annotations []checkAnnotation `json:"annotations,omitempty"`
+}
+
+type checkAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Message         string `json:"message"`
+}
+
+// configError is returned when app.yml can't be parsed
+type configError struct {
+	Path string
+	Err  error
+}
+
+func (e *configError) Error() string {
+	return e.Err.Error()
+}
+
+var configLinePattern = regexp.MustCompile(`line (\d+): (.*)`)
+
+// annotations points at the lines of app.yml named in a parse error
+func (e *configError) annotations() []checkAnnotation {
+	annotations := []checkAnnotation{}
+	for _, match := range configLinePattern.FindAllStringSubmatch(e.Err.Error(), -1) {
+		line, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		annotations = append(annotations, checkAnnotation{
+			Path:            e.Path,
+			StartLine:       line,
+			EndLine:         line,
+			AnnotationLevel: "failure",
+			Message:         match[2],
+		})
+	}
+	return annotations
+}
+
+func (ph *PullHandler) createCheckRun(ctx context.Context, owner, repo string, run *checkRun) (*checkRun, error) {
+	u := fmt.Sprintf("repos/%s/%s/check-runs", owner, repo)
+	created := &checkRun{}
+	err := retryCreate(ctx, func() error {
+		req, err := ph.client.NewRequest("POST", u, run)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", checksPreview)
+		_, err = ph.client.Do(ctx, req, created)
+		return err
+	})
+	return created, err
+}
+
+func (ph *PullHandler) updateCheckRun(ctx context.Context, owner, repo string, id int64, run *checkRun) error {
+	u := fmt.Sprintf("repos/%s/%s/check-runs/%d", owner, repo, id)
+	return retry(ctx, func() error {
+		req, err := ph.client.NewRequest("PATCH", u, run)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", checksPreview)
+		_, err = ph.client.Do(ctx, req, nil)
+		return err
+	})
+}
+
+// deployCheck reports the progress of a deploy as a check run on the head
+// commit. Only GitHub Apps may use the Checks API, so failures to report are
+// written to the deployment log instead of failing the deploy.
+type deployCheck struct {
+	ph    *PullHandler
+	owner string
+	repo  string
+	sha   string
+	id    int64
+	err   error
+}
+
+func (ph *PullHandler) queueCheck(ctx context.Context, t target) *deployCheck {
+	check := &deployCheck{
+		ph:    ph,
+		owner: t.owner,
+		repo:  t.repo,
+		sha:   t.sha,
+	}
+	run, err := ph.createCheckRun(ctx, check.owner, check.repo, &checkRun{
+		Name:    checkName,
+		HeadSha: check.sha,
+		Status:  "queued",
+	})
+	if err != nil {
+		check.err = err
+		return check
+	}
+	check.id = run.ID
+	return check
+}
+
+func (c *deployCheck) start(ctx context.Context, output io.Writer, logURL string) {
+	if c.err != nil {
+		logf(output, "Failed to create check run: %s", c.err)
+		return
+	}
+
+	now := time.Now()
+	c.update(ctx, output, &checkRun{
+		Status:     "in_progress",
+		DetailsURL: logURL,
+		StartedAt:  &now,
+	})
+}
+
+// finish completes the check run. step is the last step the deploy started,
+// which is the one that failed if the deploy did.
+func (c *deployCheck) finish(ctx context.Context, output io.Writer, record *models.Deployment, summary, step string, deployErr error) {
+	now := time.Now()
+	run := &checkRun{
+		Status:      "completed",
+		CompletedAt: &now,
+	}
+
+	switch record.State {
+	case models.StateDeployed:
+		run.Conclusion = "success"
+		run.Output = &checkOutput{Title: "Review app deployed", Summary: summary}
+	case models.DeploymentSuperseded:
+		run.Conclusion = "cancelled"
+		run.Output = &checkOutput{Title: "Review app superseded", Summary: record.Error}
+	default:
+		run.Conclusion = "failure"
+		run.Output = &checkOutput{
+			Title:   "Review app failed",
+			Summary: summary,
+			Text:    fmt.Sprintf("Failed at step: %s\n\n```\n%s\n```\n", step, record.Error),
+		}
+		if err, ok := deployErr.(*configError); ok {
+			run.Output.Annotations = err.annotations()
+		}
+	}
+
+	c.update(ctx, output, run)
+}
+
+// abandon completes the check run of a deploy that never started
+func (c *deployCheck) abandon(ctx context.Context, conclusion, title, summary string) {
+	now := time.Now()
+	c.update(ctx, ioutil.Discard, &checkRun{
+		Status:      "completed",
+		Conclusion:  conclusion,
+		CompletedAt: &now,
+		Output:      &checkOutput{Title: title, Summary: summary},
+	})
+}
+
+func (c *deployCheck) update(ctx context.Context, output io.Writer, run *checkRun) {
+	if c.id == 0 {
+		return
+	}
+	err := c.ph.updateCheckRun(ctx, c.owner, c.repo, c.id, run)
+	if err != nil {
+		logf(output, "Failed to update check run: %s", err)
+	}
+}
@@ -0,0 +1,61 @@
+package webhooks
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigErrorAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		lines   []int
+	}{
+		{"syntax", "name: web\nmanifest: manifest.yml: extra\n", []int{2}},
+		{"types", "name: [web]\nmanifest: manifest.yml\nservices: db\n", []int{1, 3}},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, "app.yml")
+		err := ioutil.WriteFile(path, []byte(test.content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = (&PullHandler{}).getAppYml(path)
+		configErr, ok := err.(*configError)
+		if !ok {
+			t.Errorf("%s: expected a config error, got %v", test.name, err)
+			continue
+		}
+
+		lines := []int{}
+		for _, annotation := range configErr.annotations() {
+			lines = append(lines, annotation.StartLine)
+			if annotation.Path != "app.yml" || annotation.EndLine != annotation.StartLine ||
+				annotation.AnnotationLevel != "failure" || annotation.Message == "" {
+				t.Errorf("%s: unexpected annotation %+v", test.name, annotation)
+			}
+		}
+		if !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: expected lines %v, got %v: %s", test.name, test.lines, lines, err)
+		}
+	}
+}
+
+func TestConfigErrorWithoutLines(t *testing.T) {
+	err := &configError{Path: "app.yml", Err: errors.New("yaml: control characters are not allowed")}
+	if annotations := err.annotations(); len(annotations) != 0 {
+		t.Errorf("Expected no annotations, got %+v", annotations)
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/google/go-github/github"
+	"github.com/jinzhu/gorm"
 	"golang.org/x/oauth2"
 	"gopkg.in/yaml.v2"
 
@@ -29,8 +31,10 @@ func Bool(b bool) *bool {
 }
 
 type WebhookClient interface {
-	Bind(owner, repo, instanceID, secret string) (int64, error)
+	Bind(owner, repo, instanceID, secret string, events []string) (int64, error)
 	Unbind(owner, repo string, hookID int64) error
+	SetSecret(owner, repo string, hookID int64, secret string) error
+	SetEvents(owner, repo string, hookID int64, events []string) error
 }
 
 type Client struct {
@@ -38,21 +42,30 @@ type Client struct {
 	settings config.Settings
 }
 
+// NewGitHubClient creates a GitHub API client authenticated by auth that
+// talks to the API at settings.GitHubURL
+func NewGitHubClient(auth oauth2.TokenSource, settings config.Settings) *github.Client {
+	client := github.NewClient(oauth2.NewClient(oauth2.NoContext, auth))
+
+	// The URL is validated when settings are loaded
+	baseURL, err := url.Parse(settings.GitHubURL)
+	if err == nil && settings.GitHubURL != "" {
+		if !strings.HasSuffix(baseURL.Path, "/") {
+			baseURL.Path += "/"
+		}
+		client.BaseURL = baseURL
+	}
+
+	return client
+}
+
 // NewClient creates a new Client
-func NewClient(token string, settings config.Settings) WebhookClient {
-	client := github.NewClient(
-		oauth2.NewClient(
-			oauth2.NoContext,
-			oauth2.StaticTokenSource(
-				&oauth2.Token{AccessToken: token},
-			),
-		),
-	)
-	return &Client{client: client, settings: settings}
+func NewClient(auth oauth2.TokenSource, settings config.Settings) WebhookClient {
+	return &Client{client: NewGitHubClient(auth, settings), settings: settings}
 }
 
-// Bind creates a GitHub webhook
-func (c *Client) Bind(owner, repo, instanceID, secret string) (int64, error) {
+// Bind creates a GitHub webhook that delivers events
+func (c *Client) Bind(owner, repo, instanceID, secret string, events []string) (int64, error) {
 	u, err := url.Parse(c.settings.BaseURL)
 	if err != nil {
 		return 0, err
@@ -62,7 +75,7 @@ func (c *Client) Bind(owner, repo, instanceID, secret string) (int64, error) {
 	hook := &github.Hook{
 		Name:   String("web"),
 		Active: Bool(true),
-		Events: []string{"pull_request"},
+		Events: events,
 		Config: map[string]interface{}{
 			"url":          u.String(),
 			"secret":       secret,
@@ -70,7 +83,14 @@ func (c *Client) Bind(owner, repo, instanceID, secret string) (int64, error) {
 		},
 	}
 
-	hook, _, err = c.client.Repositories.CreateHook(context.Background(), owner, repo, hook)
+	ctx := context.Background()
+	err = retryCreate(ctx, func() error {
+		created, _, err := c.client.Repositories.CreateHook(ctx, owner, repo, hook)
+		if err == nil {
+			hook = created
+		}
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -80,8 +100,47 @@ func (c *Client) Bind(owner, repo, instanceID, secret string) (int64, error) {
 
 // Unbind deletes a GitHub webhook
 func (c *Client) Unbind(owner, repo string, hookID int64) error {
-	_, err := c.client.Repositories.DeleteHook(context.Background(), owner, repo, hookID)
-	return err
+	ctx := context.Background()
+	return retry(ctx, func() error {
+		_, err := c.client.Repositories.DeleteHook(ctx, owner, repo, hookID)
+		return err
+	})
+}
+
+// SetSecret changes the secret of a GitHub webhook. GitHub replaces the whole
+// config of a hook when it is edited, so the rest of the config is kept as
+// it is.
+func (c *Client) SetSecret(owner, repo string, hookID int64, secret string) error {
+	ctx := context.Background()
+	var hook *github.Hook
+	err := retry(ctx, func() error {
+		var err error
+		hook, _, err = c.client.Repositories.GetHook(ctx, owner, repo, hookID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	config := map[string]interface{}{}
+	for key, value := range hook.Config {
+		config[key] = value
+	}
+	config["secret"] = secret
+
+	return retry(ctx, func() error {
+		_, _, err := c.client.Repositories.EditHook(ctx, owner, repo, hookID, &github.Hook{Config: config})
+		return err
+	})
+}
+
+// SetEvents changes the events a GitHub webhook delivers
+func (c *Client) SetEvents(owner, repo string, hookID int64, events []string) error {
+	ctx := context.Background()
+	return retry(ctx, func() error {
+		_, _, err := c.client.Repositories.EditHook(ctx, owner, repo, hookID, &github.Hook{Events: events})
+		return err
+	})
 }
 
 // https://developer.github.com/v3/activity/events/types/#pullrequestevent
@@ -89,9 +148,22 @@ type PullPayload struct {
 	Action      string
 	Number      int
 	PullRequest struct {
-		Head RefPayload
-		Base RefPayload
+		State  string
+		Head   RefPayload
+		Base   RefPayload
+		Labels []LabelPayload
 	} `json:"pull_request"`
+	// Label is the label added or removed by a labeled or unlabeled action
+	Label  LabelPayload
+	Sender UserPayload
+}
+
+type LabelPayload struct {
+	Name string
+}
+
+type UserPayload struct {
+	Login string
 }
 
 type RefPayload struct {
@@ -117,151 +189,327 @@ func (p PullPayload) IsFork() bool {
 	return p.PullRequest.Base.Repo.FullName != p.PullRequest.Head.Repo.FullName
 }
 
+// HasLabel reports whether the pull request carries the named label
+func (p PullPayload) HasLabel(name string) bool {
+	for _, label := range p.PullRequest.Labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getEnvironment names the transient GitHub environment of a review app
+func getEnvironment(hook models.Hook, t target) string {
+	prefix := hook.Environment
+	if prefix == "" {
+		prefix = "review"
+	}
+	if t.branch != "" {
+		return fmt.Sprintf("%s/branch-%s", prefix, t.branch)
+	}
+	return fmt.Sprintf("%s/pr-%d", prefix, t.number)
+}
+
 func getSpace(owner, repo string, number int) string {
 	return fmt.Sprintf("%s-%s-pull-%d", owner, repo, number)
 }
 
+// SpaceLocker serializes deploys to a space
+type SpaceLocker interface {
+	Lock(ctx context.Context, orgID, space string) (func() error, error)
+}
+
 type PullHandler struct {
 	client   *github.Client
 	cfClient *cloudfoundry.CloudFoundry
+	locker   SpaceLocker
+	db       *gorm.DB
+	settings config.Settings
+}
+
+func NewPullHandler(client *github.Client, cfClient *cloudfoundry.CloudFoundry, locker SpaceLocker, db *gorm.DB, settings config.Settings) *PullHandler {
+	return &PullHandler{client: client, cfClient: cfClient, locker: locker, db: db, settings: settings}
 }
 
-func NewPullHandler(client *github.Client, cfClient *cloudfoundry.CloudFoundry) *PullHandler {
-	return &PullHandler{client: client, cfClient: cfClient}
+// Open deploys the head of a pull request. If ctx is cancelled because a
+// newer commit superseded this one, the deploy is stopped and its GitHub
+// deployment is marked inactive.
+func (ph *PullHandler) Open(ctx context.Context, hook models.Hook, payload PullPayload) error {
+	return ph.open(ctx, hook, pullTarget(payload))
 }
 
-func (ph *PullHandler) Open(orgID string, payload PullPayload) error {
-	sha := payload.PullRequest.Head.Sha
+func (ph *PullHandler) open(ctx context.Context, hook models.Hook, t target) (err error) {
+	space := t.space()
 
-	path, err := ph.download(payload)
+	// The deployment and check run stay queued while another deploy holds
+	// the space
+	deployment, err := ph.queueDeployment(ctx, hook, t)
+	if deployment == nil {
+		return err
+	}
+	check := ph.queueCheck(ctx, t)
+
+	// A deploy that fails or is superseded before it reports its result
+	// must still finish the deployment and check run. Otherwise they stay
+	// queued, and the check blocks merging if it is required.
+	reported := false
+	defer func() {
+		if !reported && err != nil {
+			ph.abandonDeploy(ctx, t, *deployment.ID, check, err)
+		}
+	}()
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(path)
 
-	dir := fmt.Sprintf("%s-%s-%s", payload.Owner(), payload.Repo(), sha[:7])
-	appPath := filepath.Join(path, dir)
-	appYmlPath := filepath.Join(appPath, "app.yml")
+	unlock, err := ph.locker.Lock(ctx, hook.OrgID, space)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	app, err := ph.getAppYml(appYmlPath)
+	reviewApp, record, err := ph.startDeploy(hook, t, space)
 	if err != nil {
 		return err
 	}
+	record.GitHubID = *deployment.ID
 
-	here, err := os.Getwd()
+	logURL, err := ph.logURL(&record)
 	if err != nil {
 		return err
 	}
-	os.Chdir(appPath)
-	defer os.Chdir(here)
 
-	space := getSpace(payload.Owner(), payload.Repo(), payload.Number)
+	output := &deploymentLog{db: ph.db, id: record.ID}
+	logf(output, "Deploying %s to space %s", record.Sha, space)
+	check.start(ctx, output, logURL)
 
-	deployment, _, err := ph.client.Repositories.CreateDeployment(
-		context.Background(),
-		payload.Owner(), payload.Repo(),
-		&github.DeploymentRequest{
-			Ref:         String(payload.PullRequest.Head.Sha),
-			Task:        String("deploy:review"),
-			Environment: String("review"),
-		},
+	err = ph.setDeploymentStatus(
+		ctx,
+		t.owner, t.repo,
+		*deployment.ID,
+		&deploymentStatusRequest{State: "in_progress", LogURL: logURL},
 	)
 	if err != nil {
-		return err
+		logf(output, "Failed to update deployment status: %s", err)
 	}
 
-	err = ph.cfClient.Login()
-	err = ph.cfClient.Target(orgID)
-	route, err := ph.cfClient.Create(app, space)
+	err = ph.updateComment(ctx, &reviewApp, deployingComment(&record))
 	if err != nil {
-		ph.client.Repositories.CreateDeploymentStatus(
-			context.Background(),
-			payload.Owner(), payload.Repo(),
-			*deployment.ID,
-			&github.DeploymentStatusRequest{
-				State: String("error"),
-			},
-		)
-		return err
+		logf(output, "Failed to update pull request comment: %s", err)
 	}
 
-	_, _, err = ph.client.Repositories.CreateDeploymentStatus(
+	app, route, err := ph.deploy(ctx, hook, t, space, output)
+	step := output.CurrentStep()
+	if err != nil {
+		logf(output, "Deploy failed: %s", err)
+	}
+
+	recordErr := ph.finishDeploy(ctx, &reviewApp, &record, route, err)
+
+	// Report the result even if ctx has been cancelled
+	reported = true
+	statusErr := ph.setDeploymentStatus(
 		context.Background(),
-		payload.Owner(), payload.Repo(),
+		t.owner, t.repo,
 		*deployment.ID,
-		&github.DeploymentStatusRequest{
-			State:       String("success"),
-			LogURL:      String(fmt.Sprintf("https://%s", route)),
-			Description: String("Deployed review app"),
-		},
+		finishedStatus(&record, logURL),
+	)
+	check.finish(
+		context.Background(), output, &record,
+		deploySummary(&record, app, logURL), step, err,
 	)
-	return err
+
+	// A superseded deploy leaves the comment to the deploy that replaces it
+	var commentErr error
+	if ctx.Err() == nil {
+		commentErr = ph.updateComment(ctx, &reviewApp, deployedComment(&record, app))
+	}
+
+	if err != nil {
+		return err
+	}
+	if recordErr != nil {
+		return recordErr
+	}
+	if statusErr != nil {
+		return statusErr
+	}
+	return commentErr
+}
+
+func (ph *PullHandler) deploy(ctx context.Context, hook models.Hook, t target, space string, output *deploymentLog) (models.App, string, error) {
+	output.Step("Downloading %s/%s", t.owner, t.repo)
+	path, err := ph.download(ctx, t)
+	if err != nil {
+		return models.App{}, "", err
+	}
+	defer os.RemoveAll(path)
+
+	dir := fmt.Sprintf("%s-%s-%s", t.owner, t.repo, t.sha[:7])
+	appPath := filepath.Join(path, dir)
+	appYmlPath := filepath.Join(appPath, "app.yml")
+
+	output.Step("Reading app.yml")
+	app, err := ph.getAppYml(appYmlPath)
+	if err != nil {
+		return app, "", err
+	}
+
+	cfClient := ph.cfClient.Session(appPath, output)
+
+	output.Step("Logging in to Cloud Foundry")
+	err = cfClient.Login(ctx)
+	if err != nil {
+		return app, "", err
+	}
+	err = cfClient.Target(ctx, hook.OrgID)
+	if err != nil {
+		return app, "", err
+	}
+	route, err := cfClient.Create(ctx, app, space)
+	return app, route, err
 }
 
-func (ph *PullHandler) Close(orgID string, payload PullPayload) error {
-	space := getSpace(payload.Owner(), payload.Repo(), payload.Number)
+func (ph *PullHandler) Close(ctx context.Context, hook models.Hook, payload PullPayload) error {
+	return ph.close(ctx, hook, pullTarget(payload))
+}
 
-	err := ph.cfClient.Login()
-	err = ph.cfClient.Target(orgID)
-	err = ph.cfClient.Delete(space)
+func (ph *PullHandler) close(ctx context.Context, hook models.Hook, t target) error {
+	space := t.space()
 
-	deployments, _, err := ph.client.Repositories.ListDeployments(
-		context.Background(),
-		payload.Owner(), payload.Repo(),
+	unlock, err := ph.locker.Lock(ctx, hook.OrgID, space)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	reviewApp, found, err := ph.startDestroy(hook, t)
+	if err != nil {
+		return err
+	}
+
+	err = ph.destroy(ctx, hook, t, space)
+	if !found {
+		return err
+	}
+
+	recordErr := ph.finishDestroy(&reviewApp, err)
+
+	var commentErr error
+	if err == nil && reviewApp.CommentID != 0 {
+		commentErr = ph.updateComment(ctx, &reviewApp, destroyedComment())
+	}
+
+	if err != nil {
+		return err
+	}
+	if recordErr != nil {
+		return recordErr
+	}
+	return commentErr
+}
+
+func (ph *PullHandler) destroy(ctx context.Context, hook models.Hook, t target, space string) error {
+	cfClient := ph.cfClient.Session("", ioutil.Discard)
+
+	err := cfClient.Login(ctx)
+	if err != nil {
+		return err
+	}
+	err = cfClient.Target(ctx, hook.OrgID)
+	if err != nil {
+		return err
+	}
+	err = cfClient.Delete(ctx, space)
+	if err != nil {
+		return err
+	}
+
+	// Every commit of the review app was deployed to its environment
+	deployments, err := ph.listDeployments(
+		ctx,
+		t.owner, t.repo,
 		&github.DeploymentsListOptions{
-			Ref:         payload.PullRequest.Head.Sha,
 			Task:        "deploy:review",
-			Environment: "review",
+			Environment: getEnvironment(hook, t),
 		},
 	)
 	if err != nil {
 		return err
 	}
 
-	if len(deployments) == 0 {
-		return nil
+	for _, deployment := range deployments {
+		err = ph.setDeploymentStatus(
+			ctx,
+			t.owner, t.repo,
+			*deployment.ID,
+			&deploymentStatusRequest{
+				State:       "inactive",
+				Description: "Deleted review app",
+			},
+		)
+		if err != nil {
+			return err
+		}
 	}
-
-	_, _, err = ph.client.Repositories.CreateDeploymentStatus(
-		context.Background(),
-		payload.Owner(), payload.Repo(),
-		*deployments[0].ID,
-		&github.DeploymentStatusRequest{
-			State:       String("inactive"),
-			Description: String("Deleted review app"),
-		},
-	)
-	return err
+	return nil
 }
 
-func (ph *PullHandler) getArchiveURL(user, repo, sha string) (string, error) {
+func (ph *PullHandler) getArchiveURL(ctx context.Context, user, repo, sha string) (string, error) {
 	ref := &github.RepositoryContentGetOptions{Ref: sha}
-	url, _, err := ph.client.Repositories.GetArchiveLink(context.Background(), user, repo, "tarball", ref)
+	var archiveURL *url.URL
+	err := retry(ctx, func() error {
+		var err error
+		archiveURL, _, err = ph.client.Repositories.GetArchiveLink(ctx, user, repo, "tarball", ref)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
-	return url.String(), nil
+	return archiveURL.String(), nil
 }
 
-func (ph *PullHandler) download(payload PullPayload) (string, error) {
-	path, err := ioutil.TempDir("", "")
+// download extracts the tarball of the target commit to a temporary
+// directory and returns its path
+func (ph *PullHandler) download(ctx context.Context, t target) (string, error) {
+	archiveURL, err := ph.getArchiveURL(ctx, t.owner, t.repo, t.sha)
 	if err != nil {
 		return "", err
 	}
 
-	url, err := ph.getArchiveURL(payload.Owner(), payload.Repo(), payload.PullRequest.Head.Sha)
-	resp, err := http.Get(url)
+	var path string
+	err = retry(ctx, func() error {
+		path, err = ioutil.TempDir("", "")
+		if err != nil {
+			return err
+		}
+
+		err = ph.extract(ctx, archiveURL, path)
+		if err != nil {
+			os.RemoveAll(path)
+		}
+		return err
+	})
+	return path, err
+}
+
+func (ph *PullHandler) extract(ctx context.Context, archiveURL, path string) error {
+	req, err := http.NewRequest("GET", archiveURL, nil)
 	if err != nil {
-		return "", err
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 
-	err = utils.Untar(resp.Body, path)
-	if err != nil {
-		return "", err
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{StatusCode: resp.StatusCode}
 	}
 
-	return path, nil
+	return utils.Untar(resp.Body, path)
 }
 
 func (ph *PullHandler) getAppYml(path string) (models.App, error) {
@@ -273,7 +521,7 @@ func (ph *PullHandler) getAppYml(path string) (models.App, error) {
 	app := models.App{}
 	err = yaml.Unmarshal(content, &app)
 	if err != nil {
-		return models.App{}, err
+		return models.App{}, &configError{Path: "app.yml", Err: err}
 	}
 
 	return app, nil
@@ -0,0 +1,200 @@
+package webhooks
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmcarp/cf-review-app/cloudfoundry"
+	"github.com/jmcarp/cf-review-app/locks"
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/testenv"
+)
+
+const testSha = testenv.Sha
+
+// testEnv deploys review apps of owner/repo with the webhooks package
+type testEnv struct {
+	*testenv.Env
+}
+
+func newTestEnv(t *testing.T) testEnv {
+	return testEnv{testenv.New(t)}
+}
+
+func (e testEnv) pullHandler() *PullHandler {
+	cfClient := cloudfoundry.NewCloudFoundry(e.Settings.CFURL, e.Settings.CFUsername, e.Settings.CFPassword)
+	cfClient.SetPollInterval(time.Millisecond)
+
+	return NewPullHandler(
+		NewGitHubClient(Auth(e.Hook(), e.Settings), e.Settings),
+		cfClient,
+		locks.NewLocker(e.DB.DB()),
+		e.DB,
+		e.Settings,
+	)
+}
+
+func testPayload(action string) PullPayload {
+	payload := PullPayload{Action: action, Number: 1}
+	payload.PullRequest.State = "open"
+	for _, ref := range []*RefPayload{&payload.PullRequest.Head, &payload.PullRequest.Base} {
+		ref.Repo.Name = "repo"
+		ref.Repo.FullName = "owner/repo"
+		ref.Repo.Owner.Login = "owner"
+	}
+	payload.PullRequest.Head.Sha = testSha
+	return payload
+}
+
+func TestOpen(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	err := env.pullHandler().Open(context.Background(), env.Hook(), testPayload("opened"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := env.GitHub.Deployments("owner", "repo")
+	if len(deployments) != 1 {
+		t.Fatalf("Expected one deployment, got %d", len(deployments))
+	}
+	if deployments[0].Sha != testSha || deployments[0].Environment != "review/pr-1" {
+		t.Errorf("Unexpected deployment %+v", deployments[0])
+	}
+	states := env.GitHub.States(deployments[0].ID)
+	if expected := []string{"queued", "in_progress", "success"}; !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected statuses %v, got %v", expected, states)
+	}
+
+	runs := env.GitHub.CheckRuns("owner", "repo", testSha)
+	if len(runs) != 1 || runs[0].Conclusion != "success" {
+		t.Fatalf("Expected a successful check run, got %+v", runs)
+	}
+	if expected := []string{"queued", "in_progress", "completed"}; !reflect.DeepEqual(runs[0].Transitions, expected) {
+		t.Errorf("Expected check run statuses %v, got %v", expected, runs[0].Transitions)
+	}
+
+	space, ok := env.CF.Space(env.OrgGUID, "owner-repo-pull-1")
+	if !ok {
+		t.Fatal("Space was not created")
+	}
+	if apps := env.CF.Apps(space.GUID); len(apps) != 1 || !apps[0].Started {
+		t.Errorf("Expected a started app, got %+v", apps)
+	}
+
+	reviewApp := models.ReviewApp{}
+	err = env.DB.Where(models.ReviewApp{InstanceID: "instance", Number: 1}).First(&reviewApp).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reviewApp.State != models.StateDeployed || reviewApp.Sha != testSha {
+		t.Errorf("Unexpected review app %+v", reviewApp)
+	}
+
+	comments := env.GitHub.Comments("owner", "repo", 1)
+	if len(comments) != 1 || !strings.Contains(comments[0].Body, reviewApp.Route) {
+		t.Errorf("Expected a comment linking to %s, got %+v", reviewApp.Route, comments)
+	}
+}
+
+func TestOpenFailure(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	env.CF.Fail("POST", "/v3/apps", 422, -1)
+
+	err := env.pullHandler().Open(context.Background(), env.Hook(), testPayload("opened"))
+	if err == nil {
+		t.Fatal("Expected the deploy to fail")
+	}
+
+	deployments := env.GitHub.Deployments("owner", "repo")
+	if len(deployments) != 1 {
+		t.Fatalf("Expected one deployment, got %d", len(deployments))
+	}
+	states := env.GitHub.States(deployments[0].ID)
+	if expected := []string{"queued", "in_progress", "error"}; !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected statuses %v, got %v", expected, states)
+	}
+
+	runs := env.GitHub.CheckRuns("owner", "repo", testSha)
+	if len(runs) != 1 || runs[0].Conclusion != "failure" {
+		t.Fatalf("Expected a failed check run, got %+v", runs)
+	}
+	if !strings.Contains(runs[0].Output.Text, "Failed at step: Creating app web") {
+		t.Errorf("Check run doesn't name the failing step: %s", runs[0].Output.Text)
+	}
+
+	reviewApp := models.ReviewApp{}
+	err = env.DB.Where(models.ReviewApp{InstanceID: "instance", Number: 1}).First(&reviewApp).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reviewApp.State != models.StateFailed {
+		t.Errorf("Expected review app to be failed, got %s", reviewApp.State)
+	}
+}
+
+func TestOpenMissingArchive(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	payload := testPayload("opened")
+	payload.PullRequest.Head.Sha = strings.Repeat("f", 40)
+	err := env.pullHandler().Open(context.Background(), env.Hook(), payload)
+	if err == nil {
+		t.Fatal("Expected the deploy to fail")
+	}
+
+	deployments := env.GitHub.Deployments("owner", "repo")
+	if len(deployments) != 1 {
+		t.Fatalf("Expected one deployment, got %d", len(deployments))
+	}
+	states := env.GitHub.States(deployments[0].ID)
+	if expected := []string{"queued", "in_progress", "error"}; !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected statuses %v, got %v", expected, states)
+	}
+	if len(env.CF.Spaces()) != 0 {
+		t.Error("Expected no space to be created")
+	}
+}
+
+func TestClose(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	handler := env.pullHandler()
+	err := handler.Open(context.Background(), env.Hook(), testPayload("opened"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handler.Close(context.Background(), env.Hook(), testPayload("closed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := env.CF.Space(env.OrgGUID, "owner-repo-pull-1"); ok {
+		t.Error("Space was not deleted")
+	}
+
+	deployments := env.GitHub.Deployments("owner", "repo")
+	if len(deployments) != 1 {
+		t.Fatalf("Expected one deployment, got %d", len(deployments))
+	}
+	states := env.GitHub.States(deployments[0].ID)
+	if expected := []string{"queued", "in_progress", "success", "inactive"}; !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected statuses %v, got %v", expected, states)
+	}
+
+	reviewApp := models.ReviewApp{}
+	err = env.DB.Where(models.ReviewApp{InstanceID: "instance", Number: 1}).First(&reviewApp).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reviewApp.State != models.StateDestroyed {
+		t.Errorf("Expected review app to be destroyed, got %s", reviewApp.State)
+	}
+}
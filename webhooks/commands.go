@@ -0,0 +1,303 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/github"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+const commandPrefix = "/review-app"
+
+const commandUsage = "Use `/review-app deploy`, `/review-app destroy`, `/review-app redeploy` or `/review-app status`."
+
+var (
+	errClosed   = errors.New("Closed pull requests are not deployed")
+	errFork     = errors.New("Pull requests from forks are not deployed")
+	errForkSha  = errors.New("Name the commit you reviewed to deploy a pull request from a fork, e.g. `/review-app deploy <sha>`")
+	errShortSha = errors.New("Name the commit by at least 7 characters of its SHA")
+)
+
+// https://developer.github.com/v3/activity/events/types/#issuecommentevent
+type CommentPayload struct {
+	Action string
+	Issue  struct {
+		Number int
+		// PullRequest is only set for comments on pull requests
+		PullRequest *struct {
+			URL string
+		} `json:"pull_request"`
+	}
+	Comment struct {
+		ID   int64
+		Body string
+		User UserPayload
+	}
+	Repository struct {
+		Name  string
+		Owner UserPayload
+	}
+}
+
+func (p CommentPayload) Owner() string {
+	return p.Repository.Owner.Login
+}
+
+func (p CommentPayload) Repo() string {
+	return p.Repository.Name
+}
+
+// Command returns the review app command of a new pull request comment, e.g.
+// "deploy" for "/review-app deploy". The boolean result is false if the
+// comment isn't a command.
+func (p CommentPayload) Command() (string, bool) {
+	if p.Action != "created" || p.Issue.PullRequest == nil {
+		return "", false
+	}
+
+	fields := strings.Fields(p.Comment.Body)
+	if len(fields) == 0 || fields[0] != commandPrefix {
+		return "", false
+	}
+	if len(fields) == 1 {
+		return "", true
+	}
+	return fields[1], true
+}
+
+// CommandSha returns the commit that a command names, e.g. "1a2b3c4" for
+// "/review-app deploy 1a2b3c4", or "" if it names none
+func (p CommentPayload) CommandSha() string {
+	fields := strings.Fields(p.Comment.Body)
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+// Command runs a review app command from a pull request comment. The
+// comment gets a reaction when the command is accepted or refused, and a
+// reply with its result. Only users with write access may run commands;
+// commands from other users only get a reaction.
+func (ph *PullHandler) Command(ctx context.Context, hook models.Hook, payload CommentPayload) error {
+	command, ok := payload.Command()
+	if !ok {
+		return nil
+	}
+	user := payload.Comment.User.Login
+
+	trusted, err := ph.isTrusted(ctx, payload.Owner(), payload.Repo(), user)
+	if err != nil {
+		return err
+	}
+	if !trusted {
+		// Only react, so that anyone can't make the app post comments
+		return ph.react(ctx, payload, "-1")
+	}
+
+	switch command {
+	case "deploy", "destroy", "redeploy", "status":
+	default:
+		return ph.respond(ctx, payload, "confused", fmt.Sprintf(
+			"@%s Unknown command `%s %s`. %s", user, commandPrefix, command, commandUsage,
+		))
+	}
+
+	err = ph.react(ctx, payload, "+1")
+	if err != nil {
+		return err
+	}
+
+	pull, err := ph.getPull(ctx, payload.Owner(), payload.Repo(), payload.Issue.Number)
+	if err != nil {
+		return err
+	}
+	pull.Sender = payload.Comment.User
+	sha := payload.CommandSha()
+
+	var commandErr error
+	switch command {
+	case "deploy":
+		commandErr = ph.deployCommand(ctx, hook, pull, sha)
+	case "destroy":
+		commandErr = ph.Close(ctx, hook, pull)
+	case "redeploy":
+		commandErr = checkDeployable(hook, pull, sha)
+		if commandErr == nil {
+			commandErr = ph.Close(ctx, hook, pull)
+		}
+		if commandErr == nil {
+			commandErr = ph.deployCommand(ctx, hook, pull, sha)
+		}
+	}
+
+	var body string
+	if commandErr != nil {
+		body = fmt.Sprintf("@%s `%s %s` failed: %s", user, commandPrefix, command, commandErr)
+	} else {
+		status, err := ph.appStatus(hook, pull.Number)
+		if err != nil {
+			return err
+		}
+		body = fmt.Sprintf("@%s %s", user, status)
+	}
+
+	err = ph.reply(ctx, payload, body)
+	if commandErr != nil {
+		return commandErr
+	}
+	return err
+}
+
+// deployCommand deploys the head of a pull request whether or not it
+// carries the label that gates review apps. Deploying a pull request from a
+// fork approves its head.
+func (ph *PullHandler) deployCommand(ctx context.Context, hook models.Hook, pull PullPayload, sha string) error {
+	err := checkDeployable(hook, pull, sha)
+	if err != nil {
+		return err
+	}
+
+	if pull.IsFork() {
+		err = ph.approve(hook, pull)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ph.Open(ctx, hook, pull)
+}
+
+// checkDeployable checks that a command may deploy the head of a pull
+// request. The command runs some time after it was posted, so a fork must
+// name the commit that was reviewed, and the head must still be that commit;
+// otherwise a push in between would be deployed unreviewed.
+func checkDeployable(hook models.Hook, pull PullPayload, sha string) error {
+	if pull.PullRequest.State == "closed" {
+		return errClosed
+	}
+
+	if pull.IsFork() {
+		if !hook.ForkDeploys {
+			return errFork
+		}
+		if sha == "" {
+			return errForkSha
+		}
+	}
+
+	if sha == "" {
+		return nil
+	}
+	if len(sha) < 7 {
+		return errShortSha
+	}
+	head := pull.PullRequest.Head.Sha
+	if !strings.HasPrefix(head, sha) {
+		return fmt.Errorf("The head of the pull request moved to %s since %s", shortSha(head), shortSha(sha))
+	}
+	return nil
+}
+
+// appStatus describes the review app of a pull request in markdown
+func (ph *PullHandler) appStatus(hook models.Hook, number int) (string, error) {
+	reviewApp := models.ReviewApp{}
+	result := ph.db.Where(models.ReviewApp{
+		InstanceID: hook.InstanceID,
+		Number:     number,
+	}).First(&reviewApp)
+	if result.RecordNotFound() {
+		return "This pull request has no review app.", nil
+	}
+	if result.Error != nil {
+		return "", result.Error
+	}
+
+	switch reviewApp.State {
+	case models.StateDeployed:
+		return fmt.Sprintf(":rocket: %s is deployed to https://%s", shortSha(reviewApp.Sha), reviewApp.Route), nil
+	case models.StateFailed:
+		return fmt.Sprintf(":x: The review app failed:\n\n```\n%s\n```", reviewApp.Error), nil
+	case models.StateDestroyed:
+		return ":wastebasket: The review app was torn down", nil
+	}
+	return fmt.Sprintf("The review app is %s", reviewApp.State), nil
+}
+
+// respond reacts to a command and replies to it
+func (ph *PullHandler) respond(ctx context.Context, payload CommentPayload, reaction, body string) error {
+	err := ph.react(ctx, payload, reaction)
+	if err != nil {
+		return err
+	}
+	return ph.reply(ctx, payload, body)
+}
+
+func (ph *PullHandler) react(ctx context.Context, payload CommentPayload, content string) error {
+	// GitHub returns the existing reaction if it was already created
+	return retry(ctx, func() error {
+		_, _, err := ph.client.Reactions.CreateIssueCommentReaction(ctx, payload.Owner(), payload.Repo(), payload.Comment.ID, content)
+		return err
+	})
+}
+
+func (ph *PullHandler) reply(ctx context.Context, payload CommentPayload, body string) error {
+	comment := &github.IssueComment{Body: String(body)}
+	return retryCreate(ctx, func() error {
+		_, _, err := ph.client.Issues.CreateComment(ctx, payload.Owner(), payload.Repo(), payload.Issue.Number, comment)
+		return err
+	})
+}
+
+// getPull fetches a pull request in the shape of its webhook payload
+func (ph *PullHandler) getPull(ctx context.Context, owner, repo string, number int) (PullPayload, error) {
+	var pull *github.PullRequest
+	err := retry(ctx, func() error {
+		var err error
+		pull, _, err = ph.client.PullRequests.Get(ctx, owner, repo, number)
+		return err
+	})
+	if err != nil {
+		return PullPayload{}, err
+	}
+
+	payload := PullPayload{Number: number}
+	payload.PullRequest.State = pull.GetState()
+	payload.PullRequest.Head = newRefPayload(pull.GetHead())
+	payload.PullRequest.Base = newRefPayload(pull.GetBase())
+
+	// The pinned go-github doesn't decode the labels of a pull request
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		var labels []*github.Label
+		var resp *github.Response
+		err := retry(ctx, func() error {
+			var err error
+			labels, resp, err = ph.client.Issues.ListLabelsByIssue(ctx, owner, repo, number, opt)
+			return err
+		})
+		if err != nil {
+			return PullPayload{}, err
+		}
+
+		for _, label := range labels {
+			payload.PullRequest.Labels = append(payload.PullRequest.Labels, LabelPayload{Name: label.GetName()})
+		}
+		if resp.NextPage == 0 {
+			return payload, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func newRefPayload(branch *github.PullRequestBranch) RefPayload {
+	ref := RefPayload{Sha: branch.GetSHA()}
+	ref.Repo.Name = branch.GetRepo().GetName()
+	ref.Repo.FullName = branch.GetRepo().GetFullName()
+	ref.Repo.Owner.Login = branch.GetRepo().GetOwner().GetLogin()
+	return ref
+}
@@ -0,0 +1,104 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+func commentPayload(action, body string, onPull bool) CommentPayload {
+	payload := CommentPayload{Action: action}
+	payload.Comment.Body = body
+	if onPull {
+		payload.Issue.PullRequest = &struct {
+			URL string
+		}{URL: "https://api.github.com/repos/owner/repo/pulls/1"}
+	}
+	return payload
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    string
+		body      string
+		onPull    bool
+		isCommand bool
+		command   string
+		sha       string
+	}{
+		{"deploy", "created", "/review-app deploy", true, true, "deploy", ""},
+		{"deploy sha", "created", "/review-app deploy 1a2b3c4", true, true, "deploy", "1a2b3c4"},
+		{"extra whitespace", "created", "  /review-app \t status\n", true, true, "status", ""},
+		{"trailing text", "created", "/review-app destroy 1a2b3c4 please", true, true, "destroy", "1a2b3c4"},
+		{"no command", "created", "/review-app", true, true, "", ""},
+		{"unknown command", "created", "/review-app launch", true, true, "launch", ""},
+		{"not a command", "created", "Looks good", true, false, "", ""},
+		{"quoted command", "created", "Try `/review-app deploy`", true, false, "", ""},
+		{"prefix", "created", "/review-apps deploy", true, false, "", ""},
+		{"empty", "created", "", true, false, "", ""},
+		{"edited", "edited", "/review-app deploy", true, false, "", ""},
+		{"deleted", "deleted", "/review-app deploy", true, false, "", ""},
+		{"issue", "created", "/review-app deploy", false, false, "", ""},
+	}
+
+	for _, test := range tests {
+		payload := commentPayload(test.action, test.body, test.onPull)
+		command, ok := payload.Command()
+		if ok != test.isCommand || command != test.command {
+			t.Errorf("%s: expected %q, %t, got %q, %t", test.name, test.command, test.isCommand, command, ok)
+		}
+		if ok && payload.CommandSha() != test.sha {
+			t.Errorf("%s: expected sha %q, got %q", test.name, test.sha, payload.CommandSha())
+		}
+	}
+}
+
+func commandPull(state string, fork bool) PullPayload {
+	pull := PullPayload{Number: 1}
+	pull.PullRequest.State = state
+	pull.PullRequest.Head.Sha = testSha
+	pull.PullRequest.Head.Repo.FullName = "owner/repo"
+	pull.PullRequest.Base.Repo.FullName = "owner/repo"
+	if fork {
+		pull.PullRequest.Head.Repo.FullName = "fork/repo"
+	}
+	return pull
+}
+
+func TestCheckDeployable(t *testing.T) {
+	hook := models.Hook{}
+	forkHook := models.Hook{ForkDeploys: true}
+
+	tests := []struct {
+		name     string
+		hook     models.Hook
+		pull     PullPayload
+		sha      string
+		expected error
+		valid    bool
+	}{
+		{"head", hook, commandPull("open", false), "", nil, true},
+		{"named head", hook, commandPull("open", false), testSha[:7], nil, true},
+		{"full sha", hook, commandPull("open", false), testSha, nil, true},
+		{"moved", hook, commandPull("open", false), "1a2b3c4", nil, false},
+		{"short sha", hook, commandPull("open", false), testSha[:6], errShortSha, false},
+		{"closed", hook, commandPull("closed", false), "", errClosed, false},
+		{"fork", hook, commandPull("open", true), testSha[:7], errFork, false},
+		{"fork without sha", forkHook, commandPull("open", true), "", errForkSha, false},
+		{"fork with sha", forkHook, commandPull("open", true), testSha[:7], nil, true},
+		{"fork moved", forkHook, commandPull("open", true), "1a2b3c4", nil, false},
+		{"closed fork", forkHook, commandPull("closed", true), testSha[:7], errClosed, false},
+	}
+
+	for _, test := range tests {
+		err := checkDeployable(test.hook, test.pull, test.sha)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", test.name, test.valid, err)
+			continue
+		}
+		if test.expected != nil && err != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/github"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// updateComment edits the review app's pull request comment, posting a new
+// one if there is none yet or if it has been deleted. Review apps of branches
+// have no pull request to comment on.
+func (ph *PullHandler) updateComment(ctx context.Context, reviewApp *models.ReviewApp, body string) error {
+	if reviewApp.Number == 0 {
+		return nil
+	}
+
+	comment := &github.IssueComment{Body: String(body)}
+
+	if reviewApp.CommentID != 0 {
+		// The pinned go-github takes comment IDs as int when editing
+		err := retry(ctx, func() error {
+			_, _, err := ph.client.Issues.EditComment(ctx, reviewApp.Owner, reviewApp.Repo, int(reviewApp.CommentID), comment)
+			return err
+		})
+		if !isNotFound(err) {
+			return err
+		}
+	}
+
+	var created *github.IssueComment
+	err := retryCreate(ctx, func() error {
+		var err error
+		created, _, err = ph.client.Issues.CreateComment(ctx, reviewApp.Owner, reviewApp.Repo, reviewApp.Number, comment)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	reviewApp.CommentID = *created.ID
+	return ph.db.Model(reviewApp).UpdateColumn("comment_id", reviewApp.CommentID).Error
+}
+
+func isNotFound(err error) bool {
+	if err, ok := err.(*github.ErrorResponse); ok {
+		return err.Response != nil && err.Response.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+const commentHeader = "#### Review app\n\n"
+
+// deployingComment doesn't link to the deploy log, nor does deployedComment,
+// since anyone who can read the pull request can read its comments. The log
+// is linked from the deployment status and check run instead.
+func deployingComment(record *models.Deployment) string {
+	return fmt.Sprintf("%s:hourglass: Deploying %s\n", commentHeader, shortSha(record.Sha))
+}
+
+func deployedComment(record *models.Deployment, app models.App) string {
+	return commentHeader + deploySummary(record, app, "")
+}
+
+// deploySummary describes a finished deploy in markdown, linking to logURL
+// if it is set. If the deploy failed, it shows the error instead of the app.
+func deploySummary(record *models.Deployment, app models.App, logURL string) string {
+	buf := bytes.Buffer{}
+
+	if record.State == models.StateDeployed {
+		fmt.Fprintf(&buf, ":rocket: Deployed %s to https://%s\n\n", shortSha(record.Sha), record.Route)
+	} else {
+		fmt.Fprintf(&buf, ":x: Failed to deploy %s\n\n", shortSha(record.Sha))
+		fmt.Fprintf(&buf, "```\n%s\n```\n\n", record.Error)
+	}
+
+	if record.State == models.StateDeployed && len(app.Services) > 0 {
+		buf.WriteString("Services:\n\n")
+		for _, service := range app.Services {
+			fmt.Fprintf(&buf, "- `%s` (%s %s)\n", service.Name, service.Service, service.Plan)
+		}
+		buf.WriteString("\n")
+	}
+
+	if record.FinishedAt != nil {
+		duration := record.FinishedAt.Sub(record.CreatedAt).Round(time.Second)
+		if logURL != "" {
+			fmt.Fprintf(&buf, "Finished in %s ([log](%s))\n", duration, logURL)
+		} else {
+			fmt.Fprintf(&buf, "Finished in %s\n", duration)
+		}
+	}
+
+	return buf.String()
+}
+
+func destroyedComment() string {
+	return commentHeader + ":wastebasket: The review app was torn down\n"
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 7 {
+		sha = sha[:7]
+	}
+	return fmt.Sprintf("`%s`", sha)
+}
@@ -0,0 +1,137 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/github"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// Previews for the queued and in_progress states, environment_url and
+// auto_inactive
+const deploymentStatusPreview = "application/vnd.github.flash-preview+json, application/vnd.github.ant-man-preview+json"
+
+type deploymentStatusRequest struct {
+	State          string `json:"state"`
+	LogURL         string `json:"log_url,omitempty"`
+	Description    string `json:"description,omitempty"`
+	EnvironmentURL string `json:"environment_url,omitempty"`
+	AutoInactive   *bool  `json:"auto_inactive,omitempty"`
+}
+
+// queueDeployment creates a GitHub deployment of the target commit and marks
+// it queued
+func (ph *PullHandler) queueDeployment(ctx context.Context, hook models.Hook, t target) (*github.Deployment, error) {
+	deployment, err := ph.createDeployment(
+		ctx,
+		t.owner, t.repo,
+		&github.DeploymentRequest{
+			Ref:                  String(t.sha),
+			Task:                 String("deploy:review"),
+			Environment:          String(getEnvironment(hook, t)),
+			TransientEnvironment: Bool(true),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ph.setDeploymentStatus(
+		ctx,
+		t.owner, t.repo,
+		*deployment.ID,
+		&deploymentStatusRequest{State: "queued"},
+	)
+	return deployment, err
+}
+
+// abandonDeploy finishes the GitHub deployment and check run of a deploy
+// that failed, or was superseded, before it started. The result is reported
+// even if ctx has been cancelled.
+func (ph *PullHandler) abandonDeploy(ctx context.Context, t target, deploymentID int64, check *deployCheck, deployErr error) {
+	status := &deploymentStatusRequest{State: "error", Description: "Deploy failed before it started"}
+	conclusion, title := "failure", "Review app failed"
+	if ctx.Err() != nil {
+		status = &deploymentStatusRequest{State: "inactive", Description: "Superseded by a newer commit"}
+		conclusion, title = "cancelled", "Review app superseded"
+	}
+
+	// The deploy's own error is returned instead of any error reporting it
+	ph.setDeploymentStatus(context.Background(), t.owner, t.repo, deploymentID, status)
+	check.abandon(context.Background(), conclusion, title, deployErr.Error())
+}
+
+// finishedStatus describes the result of a deploy. Successful deploys mark
+// earlier deployments to the environment inactive.
+func finishedStatus(record *models.Deployment, logURL string) *deploymentStatusRequest {
+	switch record.State {
+	case models.StateDeployed:
+		return &deploymentStatusRequest{
+			State:          "success",
+			LogURL:         logURL,
+			EnvironmentURL: fmt.Sprintf("https://%s", record.Route),
+			Description:    "Deployed review app",
+			AutoInactive:   Bool(true),
+		}
+	case models.DeploymentSuperseded:
+		return &deploymentStatusRequest{
+			State:       "inactive",
+			LogURL:      logURL,
+			Description: "Superseded by a newer commit",
+		}
+	default:
+		return &deploymentStatusRequest{
+			State:  "error",
+			LogURL: logURL,
+		}
+	}
+}
+
+func (ph *PullHandler) createDeployment(ctx context.Context, owner, repo string, request *github.DeploymentRequest) (*github.Deployment, error) {
+	var deployment *github.Deployment
+	err := retryCreate(ctx, func() error {
+		var err error
+		deployment, _, err = ph.client.Repositories.CreateDeployment(ctx, owner, repo, request)
+		return err
+	})
+	return deployment, err
+}
+
+func (ph *PullHandler) setDeploymentStatus(ctx context.Context, owner, repo string, deploymentID int64, request *deploymentStatusRequest) error {
+	u := fmt.Sprintf("repos/%s/%s/deployments/%d/statuses", owner, repo, deploymentID)
+	// A repeated status restates the same state, so it is safe to retry
+	return retry(ctx, func() error {
+		req, err := ph.client.NewRequest("POST", u, request)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", deploymentStatusPreview)
+		_, err = ph.client.Do(ctx, req, nil)
+		return err
+	})
+}
+
+// listDeployments lists every page of deployments matching opt
+func (ph *PullHandler) listDeployments(ctx context.Context, owner, repo string, opt *github.DeploymentsListOptions) ([]*github.Deployment, error) {
+	deployments := []*github.Deployment{}
+	for {
+		var page []*github.Deployment
+		var resp *github.Response
+		err := retry(ctx, func() error {
+			var err error
+			page, resp, err = ph.client.Repositories.ListDeployments(ctx, owner, repo, opt)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		deployments = append(deployments, page...)
+		if resp.NextPage == 0 {
+			return deployments, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
@@ -0,0 +1,130 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/github"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// getForkLabel names the label that approves the head of a pull request from
+// a fork
+func getForkLabel(hook models.Hook) string {
+	if hook.ForkLabel == "" {
+		return "safe-to-deploy"
+	}
+	return hook.ForkLabel
+}
+
+// IsForkApproval reports whether payload is a maintainer applying the
+// approval label to a pull request from a fork
+func IsForkApproval(hook models.Hook, payload PullPayload) bool {
+	return payload.Action == "labeled" && payload.IsFork() &&
+		payload.Label.Name == getForkLabel(hook)
+}
+
+// isTrusted reports whether user may approve deploys of code from forks,
+// which requires write access to the repo
+func (ph *PullHandler) isTrusted(ctx context.Context, owner, repo, user string) (bool, error) {
+	var level *github.RepositoryPermissionLevel
+	err := retry(ctx, func() error {
+		var err error
+		level, _, err = ph.client.Repositories.GetPermissionLevel(ctx, owner, repo, user)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	switch level.GetPermission() {
+	case "admin", "write":
+		return true, nil
+	}
+	return false, nil
+}
+
+// Approve records the head of a pull request from a fork as approved by the
+// sender of payload and deploys it, unless the pull request lacks the label
+// that gates review apps. Approvals by users without write access are
+// ignored.
+func (ph *PullHandler) Approve(ctx context.Context, hook models.Hook, payload PullPayload) error {
+	trusted, err := ph.isTrusted(ctx, payload.Owner(), payload.Repo(), payload.Sender.Login)
+	if err != nil {
+		return err
+	}
+	if !trusted {
+		return nil
+	}
+
+	err = ph.approve(hook, payload)
+	if err != nil {
+		return err
+	}
+
+	if !ShouldDeploy(hook, payload) {
+		return nil
+	}
+	return ph.Open(ctx, hook, payload)
+}
+
+// approve records the head of a pull request as approved by the sender of
+// payload
+func (ph *PullHandler) approve(hook models.Hook, payload PullPayload) error {
+	return ph.db.Where(models.Approval{
+		InstanceID: hook.InstanceID,
+		Number:     payload.Number,
+		Sha:        payload.PullRequest.Head.Sha,
+	}).Attrs(models.Approval{
+		Approver: payload.Sender.Login,
+	}).FirstOrCreate(&models.Approval{}).Error
+}
+
+// OpenFork deploys the head of a pull request from a fork if a maintainer
+// has approved it. Otherwise the approval label, which applied to an earlier
+// commit, is removed and the pull request comment asks for a new approval.
+func (ph *PullHandler) OpenFork(ctx context.Context, hook models.Hook, payload PullPayload) error {
+	count := 0
+	err := ph.db.Model(&models.Approval{}).Where(models.Approval{
+		InstanceID: hook.InstanceID,
+		Number:     payload.Number,
+		Sha:        payload.PullRequest.Head.Sha,
+	}).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ph.Open(ctx, hook, payload)
+	}
+
+	label := getForkLabel(hook)
+	err = retry(ctx, func() error {
+		_, err := ph.client.Issues.RemoveLabelForIssue(ctx, payload.Owner(), payload.Repo(), payload.Number, label)
+		return err
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	t := pullTarget(payload)
+	reviewApp := models.ReviewApp{}
+	err = ph.db.Where(t.reviewApp(hook)).Attrs(models.ReviewApp{
+		Owner: t.owner,
+		Repo:  t.repo,
+		Space: t.space(),
+		State: models.StatePending,
+	}).FirstOrCreate(&reviewApp).Error
+	if err != nil {
+		return err
+	}
+
+	return ph.updateComment(ctx, &reviewApp, approvalComment(payload.PullRequest.Head.Sha, label))
+}
+
+func approvalComment(sha, label string) string {
+	return fmt.Sprintf(
+		"%s:lock: %s comes from a fork. A maintainer must add the `%s` label to deploy it.\n",
+		commentHeader, shortSha(sha), label,
+	)
+}
@@ -0,0 +1,995 @@
+// Package githubtest provides an in-memory GitHub API server for exercising
+// webhook management and pull request deploys without api.github.com.
+package githubtest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type Hook struct {
+	ID     int64
+	Owner  string
+	Repo   string
+	Name   string
+	Active bool
+	Events []string
+	Config map[string]interface{}
+}
+
+type Deployment struct {
+	ID          int64
+	Owner       string
+	Repo        string
+	Ref         string
+	Sha         string
+	Task        string
+	Environment string
+	Transient   bool
+	Payload     map[string]interface{}
+	CreatedAt   time.Time
+}
+
+type DeploymentStatus struct {
+	ID             int64
+	State          string
+	Description    string
+	LogURL         string
+	EnvironmentURL string
+	AutoInactive   *bool
+}
+
+type Comment struct {
+	ID     int64
+	Owner  string
+	Repo   string
+	Number int
+	Body   string
+}
+
+// Pull is a pull request. HeadRepo is the full name of the repo the head
+// commit comes from, which defaults to the base repo.
+type Pull struct {
+	Owner    string
+	Repo     string
+	Number   int
+	State    string
+	HeadSha  string
+	HeadRepo string
+}
+
+type Reaction struct {
+	ID        int64
+	CommentID int64
+	Content   string
+}
+
+type CheckRun struct {
+	ID          int64
+	Owner       string
+	Repo        string
+	Name        string
+	HeadSha     string `json:"head_sha"`
+	Status      string
+	Conclusion  string
+	DetailsURL  string `json:"details_url"`
+	Output      CheckOutput
+	Transitions []string `json:"-"`
+}
+
+type CheckOutput struct {
+	Title       string
+	Summary     string
+	Text        string
+	Annotations []CheckAnnotation
+}
+
+type CheckAnnotation struct {
+	Path            string
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Message         string
+}
+
+type failure struct {
+	method string
+	prefix string
+	status int
+	times  int
+}
+
+// Server is a fake GitHub API. Register archives with SetArchive before
+// deploying a commit.
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	nextID      int64
+	hooks       map[int64]*Hook
+	archives    map[string][]byte
+	deployments map[int64]*Deployment
+	statuses    map[int64][]DeploymentStatus
+	comments    map[int64]*Comment
+	checkRuns   map[int64]*CheckRun
+	permissions map[string]string
+	labels      map[string][]string
+	pulls       map[string]*Pull
+	reactions   map[int64][]Reaction
+	failures    []*failure
+	tokens      []string
+	minted      []string
+}
+
+func NewServer() *Server {
+	s := &Server{
+		hooks:       map[int64]*Hook{},
+		archives:    map[string][]byte{},
+		deployments: map[int64]*Deployment{},
+		statuses:    map[int64][]DeploymentStatus{},
+		comments:    map[int64]*Comment{},
+		checkRuns:   map[int64]*CheckRun{},
+		permissions: map[string]string{},
+		labels:      map[string][]string{},
+		pulls:       map[string]*Pull{},
+		reactions:   map[int64][]Reaction{},
+	}
+	s.Server = httptest.NewServer(s.router())
+	return s
+}
+
+// SetArchive serves files as the tarball of a commit. As on GitHub, the
+// files are nested in a directory named after the repo and short SHA.
+func (s *Server) SetArchive(owner, repo, sha string, files map[string]string) error {
+	buf := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	dir := fmt.Sprintf("%s-%s-%s/", owner, repo, sha[:7])
+	err := tarWriter.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir})
+	if err != nil {
+		return err
+	}
+	for name, content := range files {
+		err = tarWriter.WriteHeader(&tar.Header{
+			Name:     dir + name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tarWriter.Write([]byte(content))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.archives[archiveKey(owner, repo, sha)] = buf.Bytes()
+	return nil
+}
+
+// Fail makes the next `times` requests whose method matches and whose path
+// starts with prefix return status. A negative count fails forever.
+func (s *Server) Fail(method, prefix string, status, times int) {
+	if times == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &failure{method, prefix, status, times})
+}
+
+func (s *Server) Hooks(owner, repo string) []Hook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hooks := []Hook{}
+	for _, hook := range s.hooks {
+		if hook.Owner == owner && hook.Repo == repo {
+			hooks = append(hooks, *hook)
+		}
+	}
+	return hooks
+}
+
+// Deployments returns the deployments of a repo, newest first
+func (s *Server) Deployments(owner, repo string) []Deployment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deployments := []Deployment{}
+	for id := s.nextID; id > 0; id-- {
+		deployment, ok := s.deployments[id]
+		if ok && deployment.Owner == owner && deployment.Repo == repo {
+			deployments = append(deployments, *deployment)
+		}
+	}
+	return deployments
+}
+
+// Statuses returns the statuses of a deployment in the order they were
+// created
+func (s *Server) Statuses(deploymentID int64) []DeploymentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]DeploymentStatus{}, s.statuses[deploymentID]...)
+}
+
+// States returns the state of each status of a deployment in order
+func (s *Server) States(deploymentID int64) []string {
+	states := []string{}
+	for _, status := range s.Statuses(deploymentID) {
+		states = append(states, status.State)
+	}
+	return states
+}
+
+// Comments returns the comments on an issue or pull request in the order
+// they were created
+func (s *Server) Comments(owner, repo string, number int) []Comment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	comments := []Comment{}
+	for id := int64(1); id <= s.nextID; id++ {
+		comment, ok := s.comments[id]
+		if ok && comment.Owner == owner && comment.Repo == repo && comment.Number == number {
+			comments = append(comments, *comment)
+		}
+	}
+	return comments
+}
+
+// DeleteComment removes a comment, as a user might on GitHub
+func (s *Server) DeleteComment(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.comments, id)
+}
+
+// CheckRuns returns the check runs of a commit in the order they were
+// created. Transitions lists the status of each update to a run.
+func (s *Server) CheckRuns(owner, repo, sha string) []CheckRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := []CheckRun{}
+	for id := int64(1); id <= s.nextID; id++ {
+		run, ok := s.checkRuns[id]
+		if ok && run.Owner == owner && run.Repo == repo && run.HeadSha == sha {
+			runs = append(runs, *run)
+		}
+	}
+	return runs
+}
+
+// SetPermission sets the permission level of a user on a repo: admin,
+// write, read or none. Users without a permission have none.
+func (s *Server) SetPermission(owner, repo, user, permission string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.permissions[permissionKey(owner, repo, user)] = permission
+}
+
+// AddLabel applies a label to an issue or pull request
+func (s *Server) AddLabel(owner, repo string, number int, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := issueKey(owner, repo, number)
+	s.labels[key] = append(s.labels[key], label)
+}
+
+// Labels returns the labels of an issue or pull request
+func (s *Server) Labels(owner, repo string, number int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.labels[issueKey(owner, repo, number)]...)
+}
+
+// SetPull creates or replaces a pull request
+func (s *Server) SetPull(pull Pull) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pull.State == "" {
+		pull.State = "open"
+	}
+	if pull.HeadRepo == "" {
+		pull.HeadRepo = fmt.Sprintf("%s/%s", pull.Owner, pull.Repo)
+	}
+	s.pulls[issueKey(pull.Owner, pull.Repo, pull.Number)] = &pull
+}
+
+// Reactions returns the content of each reaction to a comment in the order
+// they were created
+func (s *Server) Reactions(commentID int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	contents := []string{}
+	for _, reaction := range s.reactions[commentID] {
+		contents = append(contents, reaction.Content)
+	}
+	return contents
+}
+
+// Tokens returns the credentials sent with each API request
+func (s *Server) Tokens() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.tokens...)
+}
+
+// InstallationTokens returns the installation tokens minted so far
+func (s *Server) InstallationTokens() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.minted...)
+}
+
+func (s *Server) id() int64 {
+	s.nextID++
+	return s.nextID
+}
+
+func archiveKey(owner, repo, sha string) string {
+	return fmt.Sprintf("%s/%s/%s", owner, repo, sha)
+}
+
+func permissionKey(owner, repo, user string) string {
+	return fmt.Sprintf("%s/%s/%s", owner, repo, user)
+}
+
+func issueKey(owner, repo string, number int) string {
+	return fmt.Sprintf("%s/%s/%d", owner, repo, number)
+}
+
+func (s *Server) router() http.Handler {
+	r := mux.NewRouter()
+
+	repos := r.PathPrefix("/repos/{owner}/{repo}").Subrouter()
+	repos.HandleFunc("/hooks", s.createHook).Methods("POST")
+	repos.HandleFunc("/hooks/{id}", s.getHook).Methods("GET")
+	repos.HandleFunc("/hooks/{id}", s.editHook).Methods("PATCH")
+	repos.HandleFunc("/hooks/{id}", s.deleteHook).Methods("DELETE")
+	repos.HandleFunc("/tarball/{ref}", s.getArchiveLink).Methods("GET")
+	repos.HandleFunc("/deployments", s.listDeployments).Methods("GET")
+	repos.HandleFunc("/deployments", s.createDeployment).Methods("POST")
+	repos.HandleFunc("/deployments/{id}/statuses", s.listStatuses).Methods("GET")
+	repos.HandleFunc("/deployments/{id}/statuses", s.createStatus).Methods("POST")
+	repos.HandleFunc("/check-runs", s.createCheckRun).Methods("POST")
+	repos.HandleFunc("/check-runs/{id}", s.updateCheckRun).Methods("PATCH")
+	repos.HandleFunc("/issues/{number}/comments", s.createComment).Methods("POST")
+	repos.HandleFunc("/issues/comments/{id}", s.editComment).Methods("PATCH")
+	repos.HandleFunc("/issues/{number}/labels", s.listLabels).Methods("GET")
+	repos.HandleFunc("/issues/{number}/labels/{name}", s.removeLabel).Methods("DELETE")
+	repos.HandleFunc("/issues/comments/{id}/reactions", s.createReaction).Methods("POST")
+	repos.HandleFunc("/pulls/{number}", s.getPull).Methods("GET")
+	repos.HandleFunc("/collaborators/{user}/permission", s.getPermission).Methods("GET")
+
+	r.HandleFunc("/archives/{owner}/{repo}/{ref}.tar.gz", s.getArchive).Methods("GET")
+	r.HandleFunc("/app/installations/{id}/access_tokens", s.createInstallationToken).Methods("POST")
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		status := s.injectedFailure(req)
+		authorization := req.Header.Get("Authorization")
+		if strings.HasPrefix(req.URL.Path, "/repos/") {
+			s.tokens = append(s.tokens, authorization)
+		}
+		s.mu.Unlock()
+
+		if status != 0 {
+			writeError(res, status, "Injected failure")
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/repos/") && authorization == "" {
+			writeError(res, http.StatusUnauthorized, "Requires authentication")
+			return
+		}
+
+		r.ServeHTTP(res, req)
+	})
+}
+
+func (s *Server) injectedFailure(req *http.Request) int {
+	for i, f := range s.failures {
+		if f.method != req.Method || !strings.HasPrefix(req.URL.Path, f.prefix) {
+			continue
+		}
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f.status
+	}
+	return 0
+}
+
+func (s *Server) createHook(res http.ResponseWriter, req *http.Request) {
+	hook := &Hook{}
+	if !readJSON(res, req, hook) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	hook.ID = s.id()
+	hook.Owner = vars["owner"]
+	hook.Repo = vars["repo"]
+	s.hooks[hook.ID] = hook
+	writeJSON(res, http.StatusCreated, hookResponse(hook))
+}
+
+func (s *Server) getHook(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook, ok := s.findHook(req)
+	if !ok {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	// As on GitHub, the secret is masked
+	response := hookResponse(hook)
+	config := map[string]interface{}{}
+	for key, value := range hook.Config {
+		config[key] = value
+	}
+	if _, ok := config["secret"]; ok {
+		config["secret"] = "********"
+	}
+	response["config"] = config
+	writeJSON(res, http.StatusOK, response)
+}
+
+// editHook replaces the config of a hook, as GitHub does
+func (s *Server) editHook(res http.ResponseWriter, req *http.Request) {
+	body := Hook{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook, ok := s.findHook(req)
+	if !ok {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+	if body.Config != nil {
+		hook.Config = body.Config
+	}
+	if body.Events != nil {
+		hook.Events = body.Events
+	}
+	writeJSON(res, http.StatusOK, hookResponse(hook))
+}
+
+func (s *Server) deleteHook(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook, ok := s.findHook(req)
+	if !ok {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+	delete(s.hooks, hook.ID)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) findHook(req *http.Request) (*Hook, bool) {
+	vars := mux.Vars(req)
+	id, _ := strconv.ParseInt(vars["id"], 10, 64)
+	hook, ok := s.hooks[id]
+	if !ok || hook.Owner != vars["owner"] || hook.Repo != vars["repo"] {
+		return nil, false
+	}
+	return hook, true
+}
+
+func hookResponse(hook *Hook) map[string]interface{} {
+	return map[string]interface{}{
+		"id":     hook.ID,
+		"name":   hook.Name,
+		"active": hook.Active,
+		"events": hook.Events,
+		"config": hook.Config,
+	}
+}
+
+func (s *Server) getArchiveLink(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	s.mu.Lock()
+	_, ok := s.archives[archiveKey(vars["owner"], vars["repo"], vars["ref"])]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	location := fmt.Sprintf("%s/archives/%s/%s/%s.tar.gz", s.URL, vars["owner"], vars["repo"], vars["ref"])
+	http.Redirect(res, req, location, http.StatusFound)
+}
+
+func (s *Server) getArchive(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	s.mu.Lock()
+	archive, ok := s.archives[archiveKey(vars["owner"], vars["repo"], vars["ref"])]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/x-gzip")
+	res.Write(archive)
+}
+
+func (s *Server) listDeployments(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	query := req.URL.Query()
+	matches := func(filter, value string) bool {
+		return query.Get(filter) == "" || query.Get(filter) == value
+	}
+
+	deployments := []interface{}{}
+	for id := s.nextID; id > 0; id-- {
+		deployment, ok := s.deployments[id]
+		if !ok || deployment.Owner != vars["owner"] || deployment.Repo != vars["repo"] {
+			continue
+		}
+		if matches("sha", deployment.Sha) && matches("ref", deployment.Ref) &&
+			matches("task", deployment.Task) && matches("environment", deployment.Environment) {
+			deployments = append(deployments, deploymentResponse(deployment))
+		}
+	}
+	writePage(res, req, deployments)
+}
+
+// writePage writes one page of items, linking to the next page as GitHub
+// does
+func writePage(res http.ResponseWriter, req *http.Request, items []interface{}) {
+	query := req.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	if perPage < 1 {
+		perPage = 30
+	}
+
+	start := (page - 1) * perPage
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + perPage
+	if end >= len(items) {
+		end = len(items)
+	} else {
+		next := *req.URL
+		query.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = query.Encode()
+		res.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	}
+	writeJSON(res, http.StatusOK, items[start:end])
+}
+
+func (s *Server) createDeployment(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Ref         string
+		Task        string
+		Environment string
+		Payload     map[string]interface{}
+		Transient   bool `json:"transient_environment"`
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	deployment := &Deployment{
+		ID:          s.id(),
+		Owner:       vars["owner"],
+		Repo:        vars["repo"],
+		Ref:         body.Ref,
+		Sha:         body.Ref,
+		Task:        body.Task,
+		Environment: body.Environment,
+		Transient:   body.Transient,
+		Payload:     body.Payload,
+		CreatedAt:   time.Now(),
+	}
+	if deployment.Task == "" {
+		deployment.Task = "deploy"
+	}
+	if deployment.Environment == "" {
+		deployment.Environment = "production"
+	}
+	s.deployments[deployment.ID] = deployment
+	writeJSON(res, http.StatusCreated, deploymentResponse(deployment))
+}
+
+func deploymentResponse(deployment *Deployment) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                    deployment.ID,
+		"ref":                   deployment.Ref,
+		"sha":                   deployment.Sha,
+		"task":                  deployment.Task,
+		"environment":           deployment.Environment,
+		"transient_environment": deployment.Transient,
+		"payload":               deployment.Payload,
+		"created_at":            deployment.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+func (s *Server) listStatuses(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, _ := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	statuses := []interface{}{}
+	for i := len(s.statuses[id]) - 1; i >= 0; i-- {
+		statuses = append(statuses, statusResponse(s.statuses[id][i]))
+	}
+	writeJSON(res, http.StatusOK, statuses)
+}
+
+func (s *Server) createStatus(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		State          string
+		Description    string
+		LogURL         string `json:"log_url"`
+		EnvironmentURL string `json:"environment_url"`
+		AutoInactive   *bool  `json:"auto_inactive"`
+	}{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, _ := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if _, ok := s.deployments[id]; !ok {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	status := DeploymentStatus{
+		ID:             s.id(),
+		State:          body.State,
+		Description:    body.Description,
+		LogURL:         body.LogURL,
+		EnvironmentURL: body.EnvironmentURL,
+		AutoInactive:   body.AutoInactive,
+	}
+	s.statuses[id] = append(s.statuses[id], status)
+	writeJSON(res, http.StatusCreated, statusResponse(status))
+}
+
+func statusResponse(status DeploymentStatus) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              status.ID,
+		"state":           status.State,
+		"description":     status.Description,
+		"log_url":         status.LogURL,
+		"environment_url": status.EnvironmentURL,
+	}
+}
+
+func (s *Server) createComment(res http.ResponseWriter, req *http.Request) {
+	body := struct{ Body string }{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	number, _ := strconv.Atoi(vars["number"])
+	comment := &Comment{
+		ID:     s.id(),
+		Owner:  vars["owner"],
+		Repo:   vars["repo"],
+		Number: number,
+		Body:   body.Body,
+	}
+	s.comments[comment.ID] = comment
+	writeJSON(res, http.StatusCreated, commentResponse(comment))
+}
+
+func (s *Server) editComment(res http.ResponseWriter, req *http.Request) {
+	body := struct{ Body string }{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	id, _ := strconv.ParseInt(vars["id"], 10, 64)
+	comment, ok := s.comments[id]
+	if !ok || comment.Owner != vars["owner"] || comment.Repo != vars["repo"] {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+	comment.Body = body.Body
+	writeJSON(res, http.StatusOK, commentResponse(comment))
+}
+
+func commentResponse(comment *Comment) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   comment.ID,
+		"body": comment.Body,
+	}
+}
+
+func (s *Server) createReaction(res http.ResponseWriter, req *http.Request) {
+	body := struct{ Content string }{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	id, _ := strconv.ParseInt(vars["id"], 10, 64)
+	comment, ok := s.comments[id]
+	if !ok || comment.Owner != vars["owner"] || comment.Repo != vars["repo"] {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	reaction := Reaction{ID: s.id(), CommentID: id, Content: body.Content}
+	s.reactions[id] = append(s.reactions[id], reaction)
+	writeJSON(res, http.StatusCreated, map[string]interface{}{
+		"id":      reaction.ID,
+		"content": reaction.Content,
+	})
+}
+
+func (s *Server) getPull(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	number, _ := strconv.Atoi(vars["number"])
+	key := issueKey(vars["owner"], vars["repo"], number)
+	pull, ok := s.pulls[key]
+	if !ok {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	base := fmt.Sprintf("%s/%s", pull.Owner, pull.Repo)
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"number": pull.Number,
+		"state":  pull.State,
+		"head":   branchResponse(pull.HeadSha, pull.HeadRepo),
+		"base":   branchResponse("", base),
+		"labels": labelsResponse(s.labels[key]),
+	})
+}
+
+func branchResponse(sha, fullName string) map[string]interface{} {
+	parts := strings.SplitN(fullName, "/", 2)
+	return map[string]interface{}{
+		"sha": sha,
+		"repo": map[string]interface{}{
+			"name":      parts[len(parts)-1],
+			"full_name": fullName,
+			"owner":     map[string]interface{}{"login": parts[0]},
+		},
+	}
+}
+
+func (s *Server) listLabels(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	number, _ := strconv.Atoi(vars["number"])
+	writeJSON(res, http.StatusOK, labelsResponse(s.labels[issueKey(vars["owner"], vars["repo"], number)]))
+}
+
+func (s *Server) removeLabel(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	number, _ := strconv.Atoi(vars["number"])
+	key := issueKey(vars["owner"], vars["repo"], number)
+	for i, label := range s.labels[key] {
+		if label == vars["name"] {
+			s.labels[key] = append(s.labels[key][:i], s.labels[key][i+1:]...)
+			writeJSON(res, http.StatusOK, labelsResponse(s.labels[key]))
+			return
+		}
+	}
+	writeError(res, http.StatusNotFound, "Label does not exist")
+}
+
+func labelsResponse(labels []string) []interface{} {
+	response := []interface{}{}
+	for _, label := range labels {
+		response = append(response, map[string]interface{}{"name": label})
+	}
+	return response
+}
+
+func (s *Server) getPermission(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	permission, ok := s.permissions[permissionKey(vars["owner"], vars["repo"], vars["user"])]
+	if !ok {
+		permission = "none"
+	}
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"permission": permission,
+		"user":       map[string]interface{}{"login": vars["user"]},
+	})
+}
+
+func (s *Server) createCheckRun(res http.ResponseWriter, req *http.Request) {
+	run := &CheckRun{}
+	if !readJSON(res, req, run) {
+		return
+	}
+	if run.Name == "" || run.HeadSha == "" {
+		writeError(res, http.StatusUnprocessableEntity, "Validation Failed")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	run.ID = s.id()
+	run.Owner = vars["owner"]
+	run.Repo = vars["repo"]
+	if run.Status == "" {
+		run.Status = "queued"
+	}
+	run.Transitions = []string{run.Status}
+	s.checkRuns[run.ID] = run
+	writeJSON(res, http.StatusCreated, checkRunResponse(run))
+}
+
+func (s *Server) updateCheckRun(res http.ResponseWriter, req *http.Request) {
+	body := CheckRun{}
+	if !readJSON(res, req, &body) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(req)
+	id, _ := strconv.ParseInt(vars["id"], 10, 64)
+	run, ok := s.checkRuns[id]
+	if !ok || run.Owner != vars["owner"] || run.Repo != vars["repo"] {
+		writeError(res, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	if body.Status != "" {
+		run.Status = body.Status
+	}
+	if body.Conclusion != "" {
+		run.Conclusion = body.Conclusion
+	}
+	if body.DetailsURL != "" {
+		run.DetailsURL = body.DetailsURL
+	}
+	if body.Output.Title != "" {
+		run.Output = body.Output
+	}
+	run.Transitions = append(run.Transitions, run.Status)
+	writeJSON(res, http.StatusOK, checkRunResponse(run))
+}
+
+func checkRunResponse(run *CheckRun) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          run.ID,
+		"name":        run.Name,
+		"head_sha":    run.HeadSha,
+		"status":      run.Status,
+		"conclusion":  run.Conclusion,
+		"details_url": run.DetailsURL,
+	}
+}
+
+func readJSON(res http.ResponseWriter, req *http.Request, body interface{}) bool {
+	err := json.NewDecoder(req.Body).Decode(body)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, "Problems parsing JSON")
+		return false
+	}
+	return true
+}
+
+// createInstallationToken mints a token that expires in an hour. As on
+// GitHub, the request must be authenticated with the app's JWT.
+func (s *Server) createInstallationToken(res http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		writeError(res, http.StatusUnauthorized, "Requires authentication")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := fmt.Sprintf("installation-%s-%d", mux.Vars(req)["id"], len(s.minted)+1)
+	s.minted = append(s.minted, token)
+	writeJSON(res, http.StatusCreated, map[string]interface{}{
+		"token":      token,
+		"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	})
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(body)
+}
+
+func writeError(res http.ResponseWriter, status int, message string) {
+	writeJSON(res, status, map[string]string{"message": message})
+}
@@ -0,0 +1,17 @@
+package webhooks
+
+import (
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// IsDeployLabel reports whether label is the one that gates the review apps
+// of hook
+func IsDeployLabel(hook models.Hook, label LabelPayload) bool {
+	return hook.DeployLabel != "" && label.Name == hook.DeployLabel
+}
+
+// ShouldDeploy reports whether the pull request may have a review app. If
+// hook is gated on a label, only pull requests carrying it may.
+func ShouldDeploy(hook models.Hook, payload PullPayload) bool {
+	return hook.DeployLabel == "" || payload.HasLabel(hook.DeployLabel)
+}
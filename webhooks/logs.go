@@ -0,0 +1,58 @@
+package webhooks
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// deploymentLog appends everything written to it to the log of a deployment
+// record, so that the log can be read while the deploy is still running. It
+// keeps track of the step the deploy is on.
+type deploymentLog struct {
+	db   *gorm.DB
+	id   uint
+	step string
+}
+
+func (l *deploymentLog) Write(p []byte) (int, error) {
+	err := l.db.Model(&models.Deployment{}).Where("id = ?", l.id).UpdateColumn(
+		"log", gorm.Expr("COALESCE(log, '') || ?", string(p)),
+	).Error
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Step logs the start of a step of the deploy
+func (l *deploymentLog) Step(format string, args ...interface{}) {
+	l.step = fmt.Sprintf(format, args...)
+	logf(l, format, args...)
+}
+
+// CurrentStep returns the step the deploy is on, which is the one that
+// failed if the deploy did
+func (l *deploymentLog) CurrentStep() string {
+	return l.step
+}
+
+func logf(w io.Writer, format string, args ...interface{}) {
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+// logURL returns the public address of a deployment's log
+func (ph *PullHandler) logURL(record *models.Deployment) (string, error) {
+	u, err := url.Parse(ph.settings.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(u.Path, "deployments", fmt.Sprint(record.ID), "log")
+	u.RawQuery = url.Values{"token": {record.LogToken}}.Encode()
+	return u.String(), nil
+}
@@ -1,7 +1,10 @@
 package webhooks
 
 import (
+	"time"
+
 	"github.com/jinzhu/gorm"
+	"golang.org/x/oauth2"
 
 	"github.com/jmcarp/cf-review-app/config"
 	"github.com/jmcarp/cf-review-app/models"
@@ -10,17 +13,20 @@ import (
 
 type HookManager interface {
 	Get(instanceID string) (models.Hook, error)
-	Create(orgID, instanceID, token, owner, repo string) (models.Hook, error)
+	Create(hook models.Hook) (models.Hook, error)
 	Delete(instanceID string) error
+	Rotate(instanceID string) (models.Hook, error)
+	RotateDue() error
+	UpdateEvents() error
 }
 
 type Manager struct {
 	db            *gorm.DB
 	settings      config.Settings
-	clientFactory func(token string, settings config.Settings) WebhookClient
+	clientFactory func(auth oauth2.TokenSource, settings config.Settings) WebhookClient
 }
 
-func NewManager(db *gorm.DB, settings config.Settings, factory func(token string, settings config.Settings) WebhookClient) HookManager {
+func NewManager(db *gorm.DB, settings config.Settings, factory func(auth oauth2.TokenSource, settings config.Settings) WebhookClient) HookManager {
 	return &Manager{
 		db:            db,
 		settings:      settings,
@@ -34,38 +40,68 @@ func (m *Manager) Get(instanceID string) (models.Hook, error) {
 	return hook, err
 }
 
-func (m *Manager) Create(orgID, instanceID, token, owner, repo string) (models.Hook, error) {
-	client := m.clientFactory(token, m.settings)
+// Create binds a GitHub webhook for hook and saves it with its secret
+func (m *Manager) Create(hook models.Hook) (models.Hook, error) {
+	if hook.InstallationID != 0 && m.settings.GitHubAppID == 0 {
+		return models.Hook{}, errNoGitHubApp
+	}
+	client := m.clientFactory(Auth(hook, m.settings), m.settings)
 
 	secret, err := utils.SecureRandom(32)
 	if err != nil {
 		return models.Hook{}, err
 	}
 
-	hookID, err := client.Bind(owner, repo, instanceID, secret)
+	hookID, err := client.Bind(hook.Owner, hook.Repo, hook.InstanceID, secret, webhookEvents(hook))
 	if err != nil {
 		return models.Hook{}, err
 	}
 
-	hook := models.Hook{
-		Token:      token,
-		Secret:     secret,
-		InstanceID: instanceID,
-		OrgID:      orgID,
-		Owner:      owner,
-		Repo:       repo,
-		HookID:     hookID,
-	}
+	now := time.Now()
+	hook.Secret = models.Encrypted(secret)
+	hook.SecretRotatedAt = &now
+	hook.HookID = hookID
 
 	err = m.db.Create(&hook).Error
 	if err != nil {
-		client.Unbind(owner, repo, hookID)
+		client.Unbind(hook.Owner, hook.Repo, hookID)
 		return models.Hook{}, err
 	}
 
 	return hook, nil
 }
 
+// webhookEvents lists the events delivered to hook. Pushes are only
+// delivered if branches are deployed.
+func webhookEvents(hook models.Hook) []string {
+	events := []string{"pull_request", "issue_comment"}
+	if hook.Branches != "" {
+		events = append(events, "push")
+	}
+	return events
+}
+
+// UpdateEvents subscribes the webhook of every hook to the events it needs,
+// so that hooks created by older versions receive events added since. It
+// tries every hook and returns the first error.
+func (m *Manager) UpdateEvents() error {
+	hooks := []models.Hook{}
+	err := m.db.Find(&hooks).Error
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, hook := range hooks {
+		client := m.clientFactory(Auth(hook, m.settings), m.settings)
+		err = client.SetEvents(hook.Owner, hook.Repo, hook.HookID, webhookEvents(hook))
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 func (m *Manager) Delete(instanceID string) error {
 	hook := models.Hook{InstanceID: instanceID}
 	err := m.db.Where(hook).Find(&hook).Error
@@ -73,7 +109,7 @@ func (m *Manager) Delete(instanceID string) error {
 		return err
 	}
 
-	client := m.clientFactory(hook.Token, m.settings)
+	client := m.clientFactory(Auth(hook, m.settings), m.settings)
 
 	err = client.Unbind(hook.Owner, hook.Repo, hook.HookID)
 	if err != nil {
@@ -0,0 +1,140 @@
+package webhooks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestManagerCreate(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	hook := env.Hook()
+	hook.Branches = "feature/*"
+	created, err := manager.Create(hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := env.GitHub.Hooks("owner", "repo")
+	if len(hooks) != 1 {
+		t.Fatalf("Expected one webhook, got %d", len(hooks))
+	}
+	if hooks[0].ID != created.HookID {
+		t.Errorf("Expected webhook %d, got %d", created.HookID, hooks[0].ID)
+	}
+	if expected := []string{"pull_request", "issue_comment", "push"}; !reflect.DeepEqual(hooks[0].Events, expected) {
+		t.Errorf("Expected events %v, got %v", expected, hooks[0].Events)
+	}
+	if hooks[0].Config["url"] != "https://broker.example.com/hook/instance" {
+		t.Errorf("Unexpected webhook URL %v", hooks[0].Config["url"])
+	}
+
+	saved, err := manager.Get("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Secret == "" || hooks[0].Config["secret"] != string(saved.Secret) {
+		t.Error("Saved secret doesn't match the webhook's")
+	}
+	if saved.SecretRotatedAt == nil {
+		t.Error("Expected the secret's creation to be recorded")
+	}
+}
+
+func TestManagerCreateUnbindsOnConflict(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	_, err := manager.Create(env.Hook())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second instance for the same repo and org can't be saved, so its
+	// webhook is deleted again
+	hook := env.Hook()
+	hook.InstanceID = "other-instance"
+	_, err = manager.Create(hook)
+	if err == nil {
+		t.Fatal("Expected a duplicate instance to be refused")
+	}
+
+	if hooks := env.GitHub.Hooks("owner", "repo"); len(hooks) != 1 {
+		t.Errorf("Expected one webhook, got %d", len(hooks))
+	}
+}
+
+func TestManagerCreateWithoutGitHubApp(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	hook := env.Hook()
+	hook.Token = ""
+	hook.InstallationID = 1
+	_, err := manager.Create(hook)
+	if err != errNoGitHubApp {
+		t.Fatalf("Expected %v, got %v", errNoGitHubApp, err)
+	}
+	if hooks := env.GitHub.Hooks("owner", "repo"); len(hooks) != 0 {
+		t.Errorf("Expected no webhook, got %d", len(hooks))
+	}
+}
+
+func TestManagerDelete(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	_, err := manager.Create(env.Hook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Delete("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hooks := env.GitHub.Hooks("owner", "repo"); len(hooks) != 0 {
+		t.Errorf("Expected the webhook to be deleted, got %d", len(hooks))
+	}
+	_, err = manager.Get("instance")
+	if err == nil {
+		t.Error("Expected the hook to be deleted")
+	}
+}
+
+func TestManagerUpdateEvents(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	created, err := manager.Create(env.Hook())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A hook that started deploying branches after its webhook was created
+	err = env.DB.Model(&created).UpdateColumn("branches", "feature/*").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.UpdateEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := env.GitHub.Hooks("owner", "repo")
+	if len(hooks) != 1 {
+		t.Fatalf("Expected one webhook, got %d", len(hooks))
+	}
+	if expected := []string{"pull_request", "issue_comment", "push"}; !reflect.DeepEqual(hooks[0].Events, expected) {
+		t.Errorf("Expected events %v, got %v", expected, hooks[0].Events)
+	}
+	if hooks[0].Config["secret"] != string(created.Secret) {
+		t.Error("Expected the webhook's config to be kept")
+	}
+}
@@ -0,0 +1,128 @@
+package webhooks
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/utils"
+)
+
+// startDeploy moves the target's review app to deploying, creating it if
+// needed, and records a new deployment of the target commit
+func (ph *PullHandler) startDeploy(hook models.Hook, t target, space string) (models.ReviewApp, models.Deployment, error) {
+	reviewApp := models.ReviewApp{}
+	err := ph.db.Where(t.reviewApp(hook)).Attrs(models.ReviewApp{
+		Owner: t.owner,
+		Repo:  t.repo,
+		Space: space,
+		State: models.StatePending,
+	}).FirstOrCreate(&reviewApp).Error
+	if err != nil {
+		return reviewApp, models.Deployment{}, err
+	}
+
+	if reviewApp.State == models.StateDestroyed {
+		err = reviewApp.Transition(models.StatePending)
+		if err != nil {
+			return reviewApp, models.Deployment{}, err
+		}
+	}
+	err = reviewApp.Transition(models.StateDeploying)
+	if err != nil {
+		return reviewApp, models.Deployment{}, err
+	}
+	reviewApp.Error = ""
+
+	err = ph.db.Save(&reviewApp).Error
+	if err != nil {
+		return reviewApp, models.Deployment{}, err
+	}
+
+	token, err := utils.SecureRandom(32)
+	if err != nil {
+		return reviewApp, models.Deployment{}, err
+	}
+
+	record := models.Deployment{
+		ReviewAppID: reviewApp.ID,
+		Sha:         t.sha,
+		State:       models.StateDeploying,
+		LogToken:    token,
+	}
+	err = ph.db.Create(&record).Error
+	return reviewApp, record, err
+}
+
+// finishDeploy records the result of a deploy. A deploy cancelled by a newer
+// commit leaves the app pending for the next deploy.
+func (ph *PullHandler) finishDeploy(ctx context.Context, reviewApp *models.ReviewApp, record *models.Deployment, route string, deployErr error) error {
+	now := time.Now()
+	record.FinishedAt = &now
+
+	switch {
+	case deployErr == nil:
+		record.State = models.StateDeployed
+		record.Route = route
+		reviewApp.Transition(models.StateDeployed)
+		reviewApp.Sha = record.Sha
+		reviewApp.Route = route
+		reviewApp.DeployedAt = &now
+	case ctx.Err() != nil:
+		record.State = models.DeploymentSuperseded
+		record.Error = models.ErrSuperseded.Error()
+		reviewApp.Transition(models.StatePending)
+	default:
+		record.State = models.StateFailed
+		record.Error = deployErr.Error()
+		reviewApp.Transition(models.StateFailed)
+		reviewApp.Error = deployErr.Error()
+	}
+
+	// The log is appended to separately while the deploy runs
+	err := ph.db.Omit("log").Save(record).Error
+	if err != nil {
+		return err
+	}
+	return ph.db.Save(reviewApp).Error
+}
+
+// startDestroy moves the target's review app to destroying. The boolean
+// result is false if the target has no review app, or it was already
+// destroyed.
+func (ph *PullHandler) startDestroy(hook models.Hook, t target) (models.ReviewApp, bool, error) {
+	reviewApp := models.ReviewApp{}
+	result := ph.db.Where(t.reviewApp(hook)).First(&reviewApp)
+	if result.RecordNotFound() {
+		return reviewApp, false, nil
+	}
+	if result.Error != nil {
+		return reviewApp, false, result.Error
+	}
+
+	// A duplicate close or destroy command still cleans up, in case the
+	// space outlived the review app, but leaves its record alone
+	if reviewApp.State == models.StateDestroyed {
+		return reviewApp, false, nil
+	}
+
+	err := reviewApp.Transition(models.StateDestroying)
+	if err != nil {
+		return reviewApp, true, err
+	}
+	return reviewApp, true, ph.db.Save(&reviewApp).Error
+}
+
+func (ph *PullHandler) finishDestroy(reviewApp *models.ReviewApp, destroyErr error) error {
+	if destroyErr != nil {
+		reviewApp.Transition(models.StateFailed)
+		reviewApp.Error = destroyErr.Error()
+	} else {
+		now := time.Now()
+		reviewApp.Transition(models.StateDestroyed)
+		reviewApp.Route = ""
+		reviewApp.Error = ""
+		reviewApp.DestroyedAt = &now
+	}
+	return ph.db.Save(reviewApp).Error
+}
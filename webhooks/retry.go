@@ -0,0 +1,62 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-github/github"
+
+	"github.com/jmcarp/cf-review-app/utils"
+)
+
+// statusError is an unexpected response status outside the GitHub API, such
+// as from the archive download
+type statusError struct {
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Unexpected response status %d", e.StatusCode)
+}
+
+// isTransient reports whether a failed GitHub request may succeed if retried
+func isTransient(err error) bool {
+	switch err := err.(type) {
+	case *github.AbuseRateLimitError:
+		return true
+	case *github.RateLimitError:
+		// The limit may not reset for up to an hour
+		return false
+	case *github.ErrorResponse:
+		return err.Response != nil && utils.IsTransientStatus(err.Response.StatusCode)
+	case *statusError:
+		return utils.IsTransientStatus(err.StatusCode)
+	}
+	return utils.IsNetworkError(err)
+}
+
+// isRejected reports whether a failed GitHub request was refused before it
+// had any effect
+func isRejected(err error) bool {
+	switch err := err.(type) {
+	case *github.AbuseRateLimitError:
+		return true
+	case *github.ErrorResponse:
+		return err.Response != nil && err.Response.StatusCode == http.StatusTooManyRequests
+	}
+	return utils.IsUnsent(err)
+}
+
+// retry calls fn, retrying transient GitHub failures with backoff
+func retry(ctx context.Context, fn func() error) error {
+	return utils.Retry(ctx, utils.DefaultBackoff, isTransient, fn)
+}
+
+// retryCreate calls fn, which creates a GitHub resource, retrying only
+// failures that show nothing was created. A create that failed with a
+// server error or a dropped connection may have succeeded, and repeating it
+// would create a duplicate.
+func retryCreate(ctx context.Context, fn func() error) error {
+	return utils.Retry(ctx, utils.DefaultBackoff, isRejected, fn)
+}
@@ -0,0 +1,127 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/jmcarp/cf-review-app/models"
+	"github.com/jmcarp/cf-review-app/utils"
+)
+
+// ErrRotationPending is returned by Rotate while the previous secret is
+// still accepted, since rotating again would drop it early
+var ErrRotationPending = errors.New("Secret was rotated within the grace period")
+
+// Rotate replaces the webhook secret of an instance. The new secret is saved
+// before GitHub is told about it, and the old one is kept as the previous
+// secret, so that deliveries signed with either are accepted while GitHub
+// switches over.
+func (m *Manager) Rotate(instanceID string) (models.Hook, error) {
+	hook, err := m.Get(instanceID)
+	if err != nil {
+		return models.Hook{}, err
+	}
+	if hook.AcceptsPreviousSecret(time.Now(), m.settings.SecretGracePeriod) {
+		return models.Hook{}, ErrRotationPending
+	}
+
+	secret, err := utils.SecureRandom(32)
+	if err != nil {
+		return models.Hook{}, err
+	}
+
+	// Postgres keeps microseconds, so the rollback below can match the time
+	now := time.Now().Truncate(time.Microsecond)
+	rotated := hook
+	rotated.PreviousSecret = hook.Secret
+	rotated.Secret = models.Encrypted(secret)
+	rotated.SecretRotatedAt = &now
+
+	// Only the rotation that finds the secret it read still in place wins,
+	// so that concurrent rotations can't drop a secret GitHub is using
+	columns := models.EncryptedColumns(rotated)
+	columns["secret_rotated_at"] = rotated.SecretRotatedAt
+	result := m.db.Model(&models.Hook{}).Where(
+		"id = ? AND secret_rotated_at IS NOT DISTINCT FROM ?", hook.ID, hook.SecretRotatedAt,
+	).UpdateColumns(columns)
+	if result.Error != nil {
+		return models.Hook{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return models.Hook{}, ErrRotationPending
+	}
+
+	client := m.clientFactory(Auth(hook, m.settings), m.settings)
+	err = client.SetSecret(hook.Owner, hook.Repo, hook.HookID, secret)
+	if err != nil {
+		columns = models.EncryptedColumns(hook)
+		columns["secret_rotated_at"] = hook.SecretRotatedAt
+		rollbackErr := m.db.Model(&models.Hook{}).Where(
+			"id = ? AND secret_rotated_at = ?", hook.ID, now,
+		).UpdateColumns(columns).Error
+		if rollbackErr != nil {
+			return models.Hook{}, fmt.Errorf("%s; restoring the old secret: %s", err, rollbackErr)
+		}
+		return models.Hook{}, err
+	}
+
+	return rotated, nil
+}
+
+// RotateDue retires previous secrets whose grace period has ended, and
+// rotates every secret older than the rotation interval. It tries every
+// hook and returns the first error.
+func (m *Manager) RotateDue() error {
+	now := time.Now()
+
+	err := m.db.Model(&models.Hook{}).Where(
+		"previous_secret != '' AND secret_rotated_at < ?",
+		now.Add(-m.settings.SecretGracePeriod),
+	).UpdateColumn("previous_secret", "").Error
+	if err != nil {
+		return err
+	}
+
+	if m.settings.SecretRotationInterval == 0 {
+		return nil
+	}
+
+	hooks := []models.Hook{}
+	err = m.db.Where(
+		"secret_rotated_at IS NULL OR secret_rotated_at < ?",
+		now.Add(-m.settings.SecretRotationInterval),
+	).Find(&hooks).Error
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, hook := range hooks {
+		_, err = m.Rotate(hook.InstanceID)
+		if err != nil && err != ErrRotationPending && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// RotateSecrets calls RotateDue every interval until ctx is cancelled
+func RotateSecrets(ctx context.Context, manager HookManager, interval time.Duration, logger lager.Logger) {
+	logger = logger.Session("rotate-secrets")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		err := manager.RotateDue()
+		if err != nil {
+			logger.Error("rotate", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/jmcarp/cf-review-app/models"
+)
+
+// ageSecret moves the last rotation of the instance's secret back by two
+// hours, past the test grace period
+func ageSecret(t *testing.T, env testEnv) {
+	err := env.DB.Exec(
+		"UPDATE hooks SET secret_rotated_at = secret_rotated_at - interval '2 hours'",
+	).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	created, err := manager.Create(env.Hook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSecret(t, env)
+
+	rotated, err := manager.Rotate("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Secret == created.Secret || rotated.PreviousSecret != created.Secret {
+		t.Errorf("Expected the secret to be replaced, got %+v", rotated)
+	}
+
+	hooks := env.GitHub.Hooks("owner", "repo")
+	if len(hooks) != 1 || hooks[0].Config["secret"] != string(rotated.Secret) {
+		t.Errorf("Expected the webhook to use the new secret, got %+v", hooks)
+	}
+	saved, err := manager.Get("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Secret != rotated.Secret || saved.PreviousSecret != created.Secret {
+		t.Errorf("Expected the rotation to be saved, got %+v", saved)
+	}
+}
+
+func TestRotatePending(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	_, err := manager.Create(env.Hook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSecret(t, env)
+	first, err := manager.Rotate("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating again within the grace period would drop a secret that
+	// GitHub may still sign deliveries with
+	_, err = manager.Rotate("instance")
+	if err != ErrRotationPending {
+		t.Fatalf("Expected %v, got %v", ErrRotationPending, err)
+	}
+	saved, err := manager.Get("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Secret != first.Secret || saved.PreviousSecret != first.PreviousSecret {
+		t.Errorf("Expected the first rotation to be kept, got %+v", saved)
+	}
+
+	ageSecret(t, env)
+	_, err = manager.Rotate("instance")
+	if err != nil {
+		t.Errorf("Expected a rotation after the grace period, got %v", err)
+	}
+}
+
+func TestRotateRollsBack(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	created, err := manager.Create(env.Hook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSecret(t, env)
+
+	env.GitHub.Fail("PATCH", "/repos/owner/repo/hooks", 422, -1)
+	_, err = manager.Rotate("instance")
+	if err == nil {
+		t.Fatal("Expected the rotation to fail")
+	}
+
+	saved, err := manager.Get("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Secret != created.Secret || saved.PreviousSecret != "" {
+		t.Errorf("Expected the old secret to be restored, got %+v", saved)
+	}
+}
+
+func TestRotateDue(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	manager := NewManager(env.DB, env.Settings, NewClient)
+
+	_, err := manager.Create(env.Hook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSecret(t, env)
+	_, err = manager.Rotate("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Previous secrets are retired once their grace period ends
+	ageSecret(t, env)
+	err = manager.RotateDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := models.Hook{}
+	err = env.DB.Where(models.Hook{InstanceID: "instance"}).First(&saved).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.PreviousSecret != "" {
+		t.Error("Expected the previous secret to be retired")
+	}
+}